@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"monkeylang-debug/driver"
+
+	"github.com/google/go-dap"
+)
+
+// configureCoverage records the coverage of the program if the launch
+// configuration asks for an LCOV file. It is called on the runner.
+func (h *MonkeyHandler) configureCoverage(d *driver.Driver) {
+	d.Coverage = nil
+	if h.launchArgs.Coverage != "" {
+		d.Coverage = driver.NewCoverage()
+	}
+}
+
+// writeCoverage writes the coverage of the program to the LCOV file of the
+// launch configuration once the program ended or the session is over, and
+// shows the lines that were not covered. It is called on the runner.
+func (h *MonkeyHandler) writeCoverage(d *driver.Driver) {
+	if d.Coverage == nil {
+		return
+	}
+	coverage := d.Coverage
+	d.Coverage = nil
+
+	path := h.launchArgs.Coverage
+	if err := writeFile(path, coverage.WriteLCOV); err != nil {
+		h.log.Errorf("could not write coverage: %s", err)
+		return
+	}
+	h.session.send(&dap.OutputEvent{
+		Event: *newEvent("output"),
+		Body: dap.OutputEventBody{
+			Category: "console",
+			Output:   fmt.Sprintf("%s Wrote coverage to %s.\n", coverage.Summary(), path),
+		},
+	})
+}
@@ -0,0 +1,447 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moritz-tiesler/monkey/code"
+	"github.com/moritz-tiesler/monkey/object"
+	"github.com/moritz-tiesler/monkey/vm"
+)
+
+// breakpoint is a line in source. Breakpoints without a source refer to
+// lines of the linked program.
+type breakpoint struct {
+	line   int
+	col    int
+	source string
+	id     int
+	// requested is the line the breakpoint was set on. line is the first
+	// line with code from there on, once a program is loaded.
+	requested int
+	verified  bool
+}
+
+// functionBreakpoint stops the program when the function name is called.
+type functionBreakpoint struct {
+	name     string
+	id       int
+	verified bool
+}
+
+// Breakpoint describes a breakpoint to the front-end.
+type Breakpoint struct {
+	Id int
+	// Source and Line are where the program stops. Line is after the
+	// line the breakpoint was set on if that line has no code.
+	Source string
+	Line   int
+	// Function is the name of the function of a function breakpoint.
+	Function string
+	// Verified reports whether the program can stop at the breakpoint.
+	Verified bool
+	// Message explains why a breakpoint is not verified.
+	Message string
+}
+
+func (bp breakpoint) describe() Breakpoint {
+	b := Breakpoint{Id: bp.id, Source: bp.source, Line: bp.line, Verified: bp.verified}
+	if !bp.verified {
+		b.Message = "no code on or after this line"
+	}
+	return b
+}
+
+func (bp functionBreakpoint) describe() Breakpoint {
+	b := Breakpoint{Id: bp.id, Function: bp.name, Verified: bp.verified}
+	if !bp.verified {
+		b.Message = "no function with this name"
+	}
+	return b
+}
+
+func (d *Driver) SetBreakPoints(lines []int) []Breakpoint {
+	return d.SetBreakPointsInSource("", lines)
+}
+
+// SetBreakPointsInSource replaces the breakpoints in source. Breakpoints
+// in other files are kept. A breakpoint on a line that already had one
+// keeps its id.
+func (d *Driver) SetBreakPointsInSource(source string, lines []int) []Breakpoint {
+	if source != "" {
+		source = filepath.Clean(source)
+	}
+	bps := make([]breakpoint, 0, len(d.Breakpoints)+len(lines))
+	ids := map[int]int{}
+	for _, bp := range d.Breakpoints {
+		if bp.source != source {
+			bps = append(bps, bp)
+		} else {
+			ids[bp.requested] = bp.id
+		}
+	}
+	set := make([]Breakpoint, len(lines))
+	for i, l := range lines {
+		bp := breakpoint{line: l, requested: l, source: source, id: ids[l], verified: true}
+		if bp.id == 0 {
+			bp.id = d.newBreakpointId()
+		}
+		d.place(&bp)
+		bps = append(bps, bp)
+		set[i] = bp.describe()
+	}
+	d.Breakpoints = bps
+	return set
+}
+
+// SetFunctionBreakpoints replaces the function breakpoints. The program
+// stops before the first instruction of a function with one of names.
+func (d *Driver) SetFunctionBreakpoints(names []string) []Breakpoint {
+	ids := map[string]int{}
+	for _, bp := range d.functionBreakpoints {
+		ids[bp.name] = bp.id
+	}
+	bps := make([]functionBreakpoint, len(names))
+	set := make([]Breakpoint, len(names))
+	for i, n := range names {
+		bp := functionBreakpoint{name: n, id: ids[n], verified: true}
+		if bp.id == 0 {
+			bp.id = d.newBreakpointId()
+		}
+		d.placeFunction(&bp)
+		bps[i] = bp
+		set[i] = bp.describe()
+	}
+	d.functionBreakpoints = bps
+	return set
+}
+
+func (d *Driver) newBreakpointId() int {
+	d.nextBreakpointId++
+	return d.nextBreakpointId
+}
+
+// place moves bp to the first line with code at or after the requested
+// line. Until a program is loaded, bp stays where it was set.
+func (d *Driver) place(bp *breakpoint) {
+	if d.VM == nil {
+		return
+	}
+	lines := d.codeLines(bp.source)
+	i := sort.SearchInts(lines, bp.requested)
+	if i == len(lines) {
+		bp.line = bp.requested
+		bp.verified = false
+		return
+	}
+	bp.line = lines[i]
+	bp.verified = true
+}
+
+// placeFunction verifies that the loaded program has a function named
+// like bp.
+func (d *Driver) placeFunction(bp *functionBreakpoint) {
+	if d.VM == nil {
+		return
+	}
+	bp.verified = false
+	for _, c := range d.constants {
+		if fn, ok := c.(*object.CompiledFunction); ok && fn.Name == bp.name {
+			bp.verified = true
+			return
+		}
+	}
+}
+
+// verifyBreakpoints places the breakpoints in the program that was just
+// loaded and emits BreakpointChanged for those that changed.
+func (d *Driver) verifyBreakpoints() {
+	for i := range d.Breakpoints {
+		bp := &d.Breakpoints[i]
+		before := *bp
+		d.place(bp)
+		if bp.line != before.line || bp.verified != before.verified {
+			d.emit(BreakpointChanged{Breakpoint: bp.describe()})
+		}
+	}
+	for i := range d.functionBreakpoints {
+		bp := &d.functionBreakpoints[i]
+		before := *bp
+		d.placeFunction(bp)
+		if bp.verified != before.verified {
+			d.emit(BreakpointChanged{Breakpoint: bp.describe()})
+		}
+	}
+	for i := range d.dataBreakpoints {
+		w := &d.dataBreakpoints[i]
+		before := *w
+		d.placeWatch(w)
+		if w.verified != before.verified {
+			d.emit(BreakpointChanged{Breakpoint: w.describe()})
+		}
+	}
+}
+
+// codeLines returns the lines of source that have instructions, in
+// ascending order. For source "" the lines of the linked program are
+// returned.
+func (d *Driver) codeLines(source string) []int {
+	seen := map[int]bool{}
+	for _, loc := range d.VM.LocationMap {
+		line := loc.Range.Start.Line
+		if source != "" {
+			fileLoc := d.FileLocation(line)
+			if fileLoc.Source != source {
+				continue
+			}
+			line = fileLoc.Line
+		}
+		seen[line] = true
+	}
+	lines := make([]int, 0, len(seen))
+	for l := range seen {
+		lines = append(lines, l)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// isBreakpoint reports whether bp is set on line of the linked program.
+func (d *Driver) isBreakpoint(bp breakpoint, line int) bool {
+	if bp.source == "" {
+		return bp.line == line
+	}
+	loc := d.FileLocation(line)
+	return bp.source == loc.Source && bp.line == loc.Line
+}
+
+// functionBreakpoint returns the function breakpoint on the function
+// name.
+func (d *Driver) functionBreakpoint(name string) (functionBreakpoint, bool) {
+	for _, bp := range d.functionBreakpoints {
+		if bp.name == name {
+			return bp, true
+		}
+	}
+	return functionBreakpoint{}, false
+}
+
+// DataBreakpoint watches the binding identified by DataId, see
+// DataBreakpointInfo. With Condition "changed" the program only stops
+// when the binding is written with a different value.
+type DataBreakpoint struct {
+	DataId    string
+	Condition string
+}
+
+// watch is a data breakpoint. Every let statement defines a new slot, so
+// a binding is watched by its name: the program stops after any slot of
+// that name is written in frame, or in the global store if global is set.
+type watch struct {
+	dataId   string
+	id       int
+	name     string
+	global   bool
+	frame    *vm.Frame
+	onChange bool
+	verified bool
+	message  string
+}
+
+// write is a write to a watched binding by the instruction that is about
+// to execute.
+type write struct {
+	watch watch
+	frame *vm.Frame
+	old   object.Object
+}
+
+func (w watch) describe() Breakpoint {
+	return Breakpoint{Id: w.id, Verified: w.verified, Message: w.message}
+}
+
+// DataBreakpointInfo returns the data id of the binding name that is
+// visible in the frame with the given id, and a description of it.
+// Frame 0 holds the globals.
+func (d *Driver) DataBreakpointInfo(frameId int, name string) (dataId string, description string, ok bool) {
+	if d.VM == nil || frameId < 0 || frameId >= d.VM.FramesIndex() {
+		return "", "", false
+	}
+	vmFrame := d.VM.Frames()[frameId]
+	b, ok := d.latestBinding(vmFrame, name)
+	if !ok {
+		return "", "", false
+	}
+	if b.global {
+		return "global:" + name, fmt.Sprintf("global %s", name), true
+	}
+	if d.frameKeys == nil {
+		d.frameKeys = map[*vm.Frame]int{}
+	}
+	key, ok := d.frameKeys[vmFrame]
+	if !ok {
+		key = len(d.frameKeys) + 1
+		d.frameKeys[vmFrame] = key
+	}
+	return fmt.Sprintf("local:%d:%s", key, name), fmt.Sprintf("%s in %s", name, vmFrame.Name()), true
+}
+
+// SetDataBreakpoints replaces the data breakpoints. A data breakpoint
+// that was set before with the same data id and condition keeps its id.
+func (d *Driver) SetDataBreakpoints(bps []DataBreakpoint) []Breakpoint {
+	ids := map[DataBreakpoint]int{}
+	for _, w := range d.dataBreakpoints {
+		condition := ""
+		if w.onChange {
+			condition = "changed"
+		}
+		ids[DataBreakpoint{DataId: w.dataId, Condition: condition}] = w.id
+	}
+	watches := make([]watch, 0, len(bps))
+	set := make([]Breakpoint, len(bps))
+	for i, bp := range bps {
+		w := watch{dataId: bp.DataId, id: ids[bp], verified: true}
+		if w.id == 0 {
+			w.id = d.newBreakpointId()
+		}
+		switch bp.Condition {
+		case "":
+		case "changed":
+			w.onChange = true
+		default:
+			w.verified = false
+			w.message = fmt.Sprintf("unsupported condition %q, only \"changed\" is supported", bp.Condition)
+		}
+		if w.verified {
+			d.resolveWatch(&w)
+			d.placeWatch(&w)
+		}
+		watches = append(watches, w)
+		set[i] = w.describe()
+	}
+	d.dataBreakpoints = watches
+	return set
+}
+
+// resolveWatch finds the binding of the data id of w.
+func (d *Driver) resolveWatch(w *watch) {
+	parts := strings.SplitN(w.dataId, ":", 3)
+	switch {
+	case len(parts) == 2 && parts[0] == "global":
+		w.global = true
+		w.name = parts[1]
+		return
+	case len(parts) == 3 && parts[0] == "local":
+		for f, key := range d.frameKeys {
+			if strconv.Itoa(key) == parts[1] {
+				w.name = parts[2]
+				w.frame = f
+				return
+			}
+		}
+	}
+	w.verified = false
+	w.message = fmt.Sprintf("unknown data id %q", w.dataId)
+}
+
+// placeWatch verifies that the binding of w exists in the loaded program.
+// Locals can only be watched while their frame is executing.
+func (d *Driver) placeWatch(w *watch) {
+	if d.VM == nil || w.name == "" {
+		return
+	}
+	w.verified = false
+	if w.global {
+		for i := 0; i < numGlobals(d.VM.Frames()[0].Closure().Fn); i++ {
+			if d.VM.GetGlobalName(i) == w.name {
+				w.verified = true
+				w.message = ""
+				return
+			}
+		}
+		w.message = "no global with this name"
+		return
+	}
+	for _, f := range d.VM.Frames()[:d.VM.FramesIndex()] {
+		if f == w.frame {
+			w.verified = true
+			w.message = ""
+			return
+		}
+	}
+	w.message = "the frame of this variable has returned"
+}
+
+// latestBinding returns the binding of name that was set last in vmFrame.
+func (d *Driver) latestBinding(vmFrame *vm.Frame, name string) (binding, bool) {
+	bindings := d.frameBindings(vmFrame)
+	for i := len(bindings) - 1; i >= 0; i-- {
+		if bindings[i].name == name {
+			return bindings[i], true
+		}
+	}
+	return binding{}, false
+}
+
+// watchedWrites returns the writes to watched bindings by the next
+// instruction of machine.
+func (d *Driver) watchedWrites(machine *vm.VM) []write {
+	if len(d.dataBreakpoints) == 0 {
+		return nil
+	}
+	f := machine.CurrentFrame()
+	ins := f.Instructions()
+	var name string
+	global := false
+	switch code.Opcode(ins[f.Ip]) {
+	case code.OpSetGlobal:
+		name = machine.GetGlobalName(int(code.ReadUint16(ins[f.Ip+1:])))
+		global = true
+	case code.OpSetLocal:
+		name = machine.GetLocalName(f.Closure().Fn, int(code.ReadUint8(ins[f.Ip+1:])))
+	default:
+		return nil
+	}
+
+	var writes []write
+	for _, w := range d.dataBreakpoints {
+		if !w.verified || w.name != name || w.global != global || (!global && w.frame != f) {
+			continue
+		}
+		old, _ := d.latestBinding(f, name)
+		writes = append(writes, write{watch: w, frame: f, old: old.value})
+	}
+	return writes
+}
+
+// written reports whether one of writes, that the previous instruction
+// executed, hit its data breakpoint, and records the hit.
+func (d *Driver) written(writes []write) bool {
+	for _, wr := range writes {
+		b, _ := d.latestBinding(wr.frame, wr.watch.name)
+		if wr.watch.onChange && sameValue(wr.old, b.value) {
+			continue
+		}
+		d.hitBreakpoints = append(d.hitBreakpoints, wr.watch.id)
+		d.hitBinding = wr.watch.name
+		d.hitValue = b.value
+	}
+	return len(d.hitBreakpoints) > 0
+}
+
+// sameValue reports whether a and b are the same value. Values that can
+// be hash keys are compared by value, all others by identity.
+func sameValue(a, b object.Object) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ha, ok := a.(object.Hashable)
+	hb, ok2 := b.(object.Hashable)
+	if ok && ok2 {
+		return ha.HashKey() == hb.HashKey()
+	}
+	return a == b
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/moritz-tiesler/monkey/object"
+)
+
+// builtinReceivers are the types of the first argument that the builtin
+// functions accept. Builtins without an entry accept any value.
+var builtinReceivers = map[string][]object.ObjectType{
+	"len":   {object.ARRAY_OBJ, object.STRING_OBJ},
+	"first": {object.ARRAY_OBJ},
+	"last":  {object.ARRAY_OBJ},
+	"rest":  {object.ARRAY_OBJ},
+	"push":  {object.ARRAY_OBJ},
+}
+
+// Completion is a name that completes the word at the cursor.
+type Completion struct {
+	Label string
+	// Kind is "variable", "function" or "method".
+	Kind string
+	// Detail is the signature of a function or the type of a variable.
+	Detail string
+}
+
+// Completions returns the names visible in the frame with the given id
+// that complete the word ending at the byte offset cursor of text, and
+// the offset where that word starts.
+func (d *Driver) Completions(frameId int, text string, cursor int) (int, []Completion) {
+	if cursor < 0 || cursor > len(text) {
+		cursor = len(text)
+	}
+	start := identifierStart(text, cursor)
+	prefix := text[start:cursor]
+
+	values := d.visibleValues(frameId)
+	method := start > 0 && text[start-1] == '.'
+	var receiver object.Object
+	if method {
+		dot := start - 1
+		receiver = values[text[identifierStart(text, dot):dot]]
+	}
+
+	completions := []Completion{}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		value := values[name]
+		cl, isFunction := value.(*object.Closure)
+		if method {
+			// The value before the "." is passed as the first argument.
+			if isFunction && cl.Fn.NumParameters > 0 {
+				completions = append(completions, Completion{Label: name, Kind: "method", Detail: d.signature(cl.Fn)})
+			}
+			continue
+		}
+		if isFunction {
+			completions = append(completions, Completion{Label: name, Kind: "function", Detail: d.signature(cl.Fn)})
+		} else {
+			completions = append(completions, Completion{Label: name, Kind: "variable", Detail: string(value.Type())})
+		}
+	}
+
+	for _, b := range object.Builtins {
+		if _, shadowed := values[b.Name]; shadowed || !strings.HasPrefix(b.Name, prefix) {
+			continue
+		}
+		kind := "function"
+		if method {
+			if receiver != nil && !acceptsReceiver(b.Name, receiver) {
+				continue
+			}
+			kind = "method"
+		}
+		completions = append(completions, Completion{Label: b.Name, Kind: kind, Detail: fmt.Sprintf("fn(%s)", builtinParameters[b.Name])})
+	}
+	return start, completions
+}
+
+// visibleValues returns the values of the globals that have been set and
+// of the locals of the frame with the given id, by name. Locals shadow
+// globals, a function is visible by its own name inside its frame.
+func (d *Driver) visibleValues(frameId int) map[string]object.Object {
+	values := map[string]object.Object{}
+	if d.VM == nil || frameId < 0 || frameId >= d.VM.FramesIndex() {
+		return values
+	}
+	vmFrames := d.VM.Frames()
+	for _, b := range d.frameBindings(vmFrames[0]) {
+		if b.value != nil {
+			values[b.name] = b.value
+		}
+	}
+	if frameId > 0 {
+		vmFrame := vmFrames[frameId]
+		if name := vmFrame.Name(); name != "" {
+			if _, ok := values[name]; !ok {
+				values[name] = vmFrame.Closure()
+			}
+		}
+		for _, b := range d.frameBindings(vmFrame) {
+			if b.value != nil {
+				values[b.name] = b.value
+			}
+		}
+	}
+	return values
+}
+
+// signature returns the parameters of fn in the notation of the builtins
+// listing.
+func (d *Driver) signature(fn *object.CompiledFunction) string {
+	params := make([]string, fn.NumParameters)
+	for i := range params {
+		params[i] = d.VM.GetLocalName(fn, i)
+	}
+	return fmt.Sprintf("fn(%s)", strings.Join(params, ", "))
+}
+
+func acceptsReceiver(builtin string, receiver object.Object) bool {
+	types, ok := builtinReceivers[builtin]
+	if !ok {
+		return true
+	}
+	for _, t := range types {
+		if receiver.Type() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// identifierStart returns the offset of the identifier that ends at end
+// of text.
+func identifierStart(text string, end int) int {
+	start := end
+	for start > 0 && isIdentifierChar(text[start-1]) {
+		start--
+	}
+	return start
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
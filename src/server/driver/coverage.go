@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moritz-tiesler/monkey/code"
+	"github.com/moritz-tiesler/monkey/compiler"
+	"github.com/moritz-tiesler/monkey/object"
+	"github.com/moritz-tiesler/monkey/vm"
+)
+
+// Coverage records which lines of a program were executed and how often
+// its functions were called. Set it as Driver.Coverage before the program
+// runs, WriteLCOV exports it in the LCOV format.
+type Coverage struct {
+	// lines are the executions of every line that has code, by line.
+	lines     map[Location]int
+	functions map[*object.CompiledFunction]*coveredFunction
+	// executed are the lines each frame of the call stack executed so
+	// far, by call depth. Monkey has no loops, so a line is executed at
+	// most once per call, even if it is left and entered again, e.g. after
+	// a branch of an if expression.
+	executed []map[Location]bool
+}
+
+type coveredFunction struct {
+	name string
+	// start is the line of the function literal.
+	start Location
+	calls int
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{}
+}
+
+// load finds the lines and functions of the program of machine. A
+// function starts where the enclosing scope creates its closure, at the
+// function literal.
+func (c *Coverage) load(d *Driver, machine *vm.VM) {
+	c.lines = map[Location]int{}
+	c.functions = map[*object.CompiledFunction]*coveredFunction{}
+	for key, loc := range machine.LocationMap {
+		line := d.FileLocation(loc.Range.Start.Line)
+		c.lines[line] = 0
+
+		ins := key.ScopeId.Instructions
+		if key.InstructionIndex >= len(ins) || code.Opcode(ins[key.InstructionIndex]) != code.OpClosure {
+			continue
+		}
+		index := int(code.ReadUint16(ins[key.InstructionIndex+1:]))
+		if index >= len(d.constants) {
+			continue
+		}
+		fn, ok := d.constants[index].(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		c.functions[fn] = &coveredFunction{name: fn.Name, start: line}
+	}
+	for _, fn := range c.functions {
+		// Function names must be unique in LCOV.
+		if fn.name == "" {
+			fn.name = fmt.Sprintf("anonymous@%d", fn.start.Line)
+		}
+	}
+}
+
+// record counts the instruction machine is about to execute.
+func (c *Coverage) record(d *Driver, machine *vm.VM) {
+	if c.lines == nil {
+		c.load(d, machine)
+	}
+	depth := machine.FramesIndex() - 1
+	for len(c.executed) <= depth {
+		c.executed = append(c.executed, map[Location]bool{})
+	}
+	f := machine.CurrentFrame()
+	fn := f.Closure().Fn
+	if f.Ip == 0 {
+		c.executed[depth] = map[Location]bool{}
+		if covered, ok := c.functions[fn]; ok {
+			covered.calls++
+		}
+	}
+	// Only instructions that start an expression are mapped to a line.
+	// The others may belong to a branch that is not taken.
+	loc, ok := machine.LocationMap[compiler.LocationKey{ScopeId: fn, InstructionIndex: f.Ip}]
+	if !ok {
+		return
+	}
+	line := d.FileLocation(loc.Range.Start.Line)
+	if !c.executed[depth][line] {
+		c.executed[depth][line] = true
+		c.lines[line]++
+	}
+}
+
+// Lines returns how often each line with code was executed.
+func (c *Coverage) Lines() map[Location]int {
+	lines := make(map[Location]int, len(c.lines))
+	for line, n := range c.lines {
+		lines[line] = n
+	}
+	return lines
+}
+
+// Uncovered returns the lines with code that were never executed, sorted
+// by source and line.
+func (c *Coverage) Uncovered() []Location {
+	uncovered := []Location{}
+	for line, n := range c.lines {
+		if n == 0 {
+			uncovered = append(uncovered, line)
+		}
+	}
+	sortLocations(uncovered)
+	return uncovered
+}
+
+// Summary returns the share of the lines that were executed and the
+// lines that were not, with runs of lines joined into ranges.
+func (c *Coverage) Summary() string {
+	uncovered := c.Uncovered()
+	total := len(c.lines)
+	covered := total - len(uncovered)
+	percent := 100.0
+	if total > 0 {
+		percent = float64(covered) * 100 / float64(total)
+	}
+	summary := fmt.Sprintf("Covered %d of %d lines (%.1f%%).", covered, total, percent)
+	if len(uncovered) == 0 {
+		return summary
+	}
+
+	var ranges []string
+	for i := 0; i < len(uncovered); {
+		first := uncovered[i]
+		last := first
+		j := i + 1
+		// Lines without code do not interrupt a range.
+		for j < len(uncovered) && uncovered[j].Source == first.Source && c.onlyUncovered(first.Source, last.Line, uncovered[j].Line) {
+			last = uncovered[j]
+			j++
+		}
+		name := first.Source
+		if name == "" {
+			name = "line "
+		} else {
+			name = filepath.Base(name) + ":"
+		}
+		if last.Line == first.Line {
+			ranges = append(ranges, fmt.Sprintf("%s%d", name, first.Line))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%s%d-%d", name, first.Line, last.Line))
+		}
+		i = j
+	}
+	return fmt.Sprintf("%s Not covered: %s", summary, strings.Join(ranges, ", "))
+}
+
+// onlyUncovered reports whether none of the lines of source after from up
+// to to were executed.
+func (c *Coverage) onlyUncovered(source string, from, to int) bool {
+	for line := from + 1; line < to; line++ {
+		if c.lines[Location{Source: source, Line: line}] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteLCOV writes the coverage as an LCOV tracefile with a record for
+// every source of the program, as read by genhtml and most editors.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	sources := map[string][]Location{}
+	for line := range c.lines {
+		sources[line.Source] = append(sources[line.Source], line)
+	}
+	functions := map[string][]*coveredFunction{}
+	for _, fn := range c.functions {
+		functions[fn.start.Source] = append(functions[fn.start.Source], fn)
+	}
+	names := make([]string, 0, len(sources))
+	for source := range sources {
+		names = append(names, source)
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "TN:")
+	for _, source := range names {
+		fmt.Fprintf(out, "SF:%s\n", source)
+
+		fns := functions[source]
+		sort.Slice(fns, func(i, j int) bool {
+			if fns[i].start.Line != fns[j].start.Line {
+				return fns[i].start.Line < fns[j].start.Line
+			}
+			return fns[i].name < fns[j].name
+		})
+		hit := 0
+		for _, fn := range fns {
+			fmt.Fprintf(out, "FN:%d,%s\n", fn.start.Line, fn.name)
+		}
+		for _, fn := range fns {
+			fmt.Fprintf(out, "FNDA:%d,%s\n", fn.calls, fn.name)
+			if fn.calls > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "FNF:%d\nFNH:%d\n", len(fns), hit)
+
+		lines := sources[source]
+		sortLocations(lines)
+		hit = 0
+		for _, line := range lines {
+			fmt.Fprintf(out, "DA:%d,%d\n", line.Line, c.lines[line])
+			if c.lines[line] > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "LF:%d\nLH:%d\n", len(lines), hit)
+		fmt.Fprintln(out, "end_of_record")
+	}
+	return out.Flush()
+}
+
+func sortLocations(locations []Location) {
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].Source != locations[j].Source {
+			return locations[i].Source < locations[j].Source
+		}
+		return locations[i].Line < locations[j].Line
+	})
+}
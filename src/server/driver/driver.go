@@ -1,8 +1,15 @@
 package driver
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/moritz-tiesler/monkey/ast"
 	"github.com/moritz-tiesler/monkey/compiler"
 	"github.com/moritz-tiesler/monkey/exception"
 	"github.com/moritz-tiesler/monkey/lexer"
@@ -11,53 +18,110 @@ import (
 	"github.com/moritz-tiesler/monkey/vm"
 )
 
-type breakpoint struct {
-	line int
-	col  int
-}
-
 type Driver struct {
-	VM                  *vm.VM
-	Breakpoints         []breakpoint
-	Source              string
-	SourceCode          string
+	VM          *vm.VM
+	Breakpoints []breakpoint
+	Source      string
+	// SourceCode is the program after imports have been resolved.
+	SourceCode string
+	// Files are the files the program is made of, starting with Source.
+	Files               []SourceFile
+	origins             []Location
 	stoppedOnBreakpoint bool
-	Frames              []DebugFrame
-	Errors              []exception.Exception
+	functionBreakpoints []functionBreakpoint
+	// nextBreakpointId is the id of the next breakpoint that is set.
+	nextBreakpointId int
+	// hitFunction is the function breakpoint the program stopped on.
+	hitFunction string
+	// hitBreakpoints are the ids of the breakpoints the program stopped on.
+	hitBreakpoints  []int
+	dataBreakpoints []watch
+	// frameKeys identify the frames of watched locals in data ids.
+	frameKeys map[*vm.Frame]int
+	// hitBinding is the binding a data breakpoint stopped on.
+	hitBinding string
+	hitValue   object.Object
+	Frames     []DebugFrame
+	Errors     []exception.Exception
+
+	state       State
+	pauseReason PauseReason
+	result      object.Object
+
+	// OnCycle is called before every instruction with the number of
+	// instructions the run executed so far.
+	OnCycle func(executed int)
+	// Trace is called with every call and return of the program.
+	Trace        func(entry TraceEntry)
+	depth        int
+	instructions int
+	calls        []TraceEntry
+	// returnValue is the value the last call returned to returnFrame
+	// during StepOver or StepOut.
+	keepReturns bool
+	returnValue object.Object
+	returnFrame *vm.Frame
+	Profile     *Profile
+	Coverage    *Coverage
+	// MaxCallDepth and MaxInstructions limit the program, see LimitError.
+	MaxCallDepth    int
+	MaxInstructions int
+	limitErr        exception.Exception
+	cycleFrame      *vm.Frame
+	cycleIp         int
+	// failedFrame is the frame the program failed in.
+	failedFrame *vm.Frame
+	failedAt    compiler.LocationData
+	operands    []DriverVar
+	Logf        func(format string, args ...any)
+	cancelled   int32
+	constants   []object.Object
+	program     *ast.Program
+	// serveQueries answers the queries of the Runner that owns the driver.
+	serveQueries func()
+	observers    []func(e Event)
 }
 
+// ErrCancelled is returned by runs that were interrupted by Cancel.
+var ErrCancelled = errors.New("cancelled")
+
+// ErrProgramFailed is returned by runs of a program that stopped with a
+// runtime error. The failed program can be inspected but not run on.
+var ErrProgramFailed = errors.New("program has failed")
+
+// State is the state of the program of a driver.
 type State int
 
 const (
-	OFF State = iota
-	STOPPED
-	DONE
+	NOT_STARTED State = iota
+	RUNNING
+	// PAUSED is the state of a program that stopped before an
+	// instruction, see PauseReason.
+	PAUSED
+	EXITED
 	COMPILER_ERROR
 	RUNTIME_ERROR
 )
 
-func (d Driver) State() State {
-	if d.VM == nil {
-		// VM has not been initialized
-		return COMPILER_ERROR
-	}
-
-	vs := d.VM.State()
-	if d.HasErrors() && vs == vm.STOPPED {
-		return RUNTIME_ERROR
-	}
-	return State(vs)
+// transitions are the states each state may change to. Reset starts over
+// from NOT_STARTED in any state.
+var transitions = map[State][]State{
+	NOT_STARTED: {RUNNING, PAUSED, COMPILER_ERROR},
+	RUNNING:     {PAUSED, EXITED, RUNTIME_ERROR},
+	PAUSED:      {RUNNING, PAUSED},
 }
 
 func (st State) String() string {
 	var s string
 	switch st {
-	case OFF:
-		s = "OFF"
-	case STOPPED:
-		s = "STOPPED"
-	case DONE:
-		s = "DONE"
+	case NOT_STARTED:
+		s = "NOT_STARTED"
+	case RUNNING:
+		s = "RUNNING"
+	case PAUSED:
+		s = "PAUSED"
+	case EXITED:
+		s = "EXITED"
 	case RUNTIME_ERROR:
 		s = "RUNTIME_ERROR"
 	case COMPILER_ERROR:
@@ -67,6 +131,95 @@ func (st State) String() string {
 	return s
 }
 
+// PauseReason is why a program was paused.
+type PauseReason int
+
+const (
+	PausedOnBreakpoint PauseReason = iota
+	PausedOnFunctionBreakpoint
+	PausedOnDataBreakpoint
+	PausedAfterStep
+	PausedOnEntry
+	PausedByCancel
+	PausedAfterGoto
+)
+
+func (r PauseReason) String() string {
+	switch r {
+	case PausedOnBreakpoint:
+		return "breakpoint"
+	case PausedOnFunctionBreakpoint:
+		return "function breakpoint"
+	case PausedOnDataBreakpoint:
+		return "data breakpoint"
+	case PausedAfterStep:
+		return "step"
+	case PausedOnEntry:
+		return "entry"
+	case PausedByCancel:
+		return "cancel"
+	case PausedAfterGoto:
+		return "goto"
+	}
+	return fmt.Sprintf("PauseReason(%d)", int(r))
+}
+
+func (d Driver) State() State {
+	return d.state
+}
+
+// PauseReason returns why the program was paused. It is only meaningful
+// in state PAUSED.
+func (d Driver) PauseReason() PauseReason {
+	return d.pauseReason
+}
+
+// Result returns the value of the last expression statement of a program
+// that has exited, nil if there was none.
+func (d Driver) Result() object.Object {
+	return d.result
+}
+
+// ExitCode returns 0 for a program that ran to completion and 1 for a
+// program that failed to compile or run.
+func (d Driver) ExitCode() int {
+	switch d.state {
+	case COMPILER_ERROR, RUNTIME_ERROR:
+		return 1
+	}
+	return 0
+}
+
+// setState moves the program to state to, if the current state allows it.
+func (d *Driver) setState(to State) error {
+	for _, allowed := range transitions[d.state] {
+		if allowed == to {
+			d.logf("state %s -> %s", d.state, to)
+			d.state = to
+			return nil
+		}
+	}
+	return fmt.Errorf("program cannot change from state=%s to %s", d.state, to)
+}
+
+// startRun moves the program to RUNNING before a command runs the VM.
+func (d *Driver) startRun() error {
+	if d.VM == nil {
+		return errors.New("program is not loaded")
+	}
+	if d.state == RUNTIME_ERROR {
+		return fmt.Errorf("%w: %s", ErrProgramFailed, d.Errors[len(d.Errors)-1])
+	}
+	d.hitFunction = ""
+	d.hitBreakpoints = nil
+	d.hitBinding = ""
+	d.hitValue = nil
+	d.keepReturns = false
+	d.returnValue = nil
+	d.returnFrame = nil
+	return d.setState(RUNNING)
+}
+
 func (d Driver) HasErrors() bool {
 	return len(d.Errors) > 0
 }
@@ -78,14 +231,6 @@ func New() *Driver {
 	}
 }
 
-func (d *Driver) SetBreakPoints(lines []int) {
-	bps := make([]breakpoint, len(lines))
-	for i, l := range lines {
-		bps[i] = breakpoint{line: l}
-	}
-	d.Breakpoints = bps
-}
-
 func (d *Driver) BreakpoinState() string {
 	state := ""
 
@@ -94,12 +239,12 @@ func (d *Driver) BreakpoinState() string {
 		padding := ""
 		lineNum := i + 1
 		for _, bp := range d.Breakpoints {
-			if bp.line == lineNum {
+			if d.isBreakpoint(bp, lineNum) {
 				padding = padding + "#"
 				break
 			}
 		}
-		vmLoc := d.VM.SourceLocation()
+		vmLoc := currentLocation(d.VM)
 		if vmLoc.Range.Start.Line == lineNum {
 			padding = padding + "->"
 		}
@@ -114,37 +259,196 @@ func (d *Driver) BreakpoinState() string {
 	return state
 }
 
+// Load reads the program at path, resolves its imports and starts a VM
+// for it.
+func (d *Driver) Load(path string) error {
+	path = filepath.Clean(path)
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return d.link(path, string(code))
+}
+
+// LoadSource starts a VM for a program that does not exist on disk.
+// Imports are resolved relative to the working directory.
+func (d *Driver) LoadSource(sourceCode string) error {
+	return d.link("", sourceCode)
+}
+
+func (d *Driver) link(path string, code string) error {
+	d.Source = path
+	linked, err := link(path, code)
+	d.Files = linked.files
+	d.origins = linked.origins
+	d.SourceCode = strings.Join(linked.lines, "\n")
+	if err != nil {
+		importErr := err.(ImportError)
+		d.Errors = append(d.Errors, importErr)
+		d.setState(COMPILER_ERROR)
+		d.emit(Errored{Err: importErr, Location: d.FileLocation(importErr.Line())})
+		return importErr
+	}
+	d.logf("linked %d files into %d lines", len(d.Files), len(d.origins))
+	return d.StartVM(d.SourceCode)
+}
+
+// Reset discards the VM and everything that was recorded while running
+// it. Breakpoints are kept.
+func (d *Driver) Reset() {
+	d.VM = nil
+	d.Errors = nil
+	d.Frames = nil
+	d.Files = nil
+	d.origins = nil
+	d.stoppedOnBreakpoint = false
+	d.constants = nil
+	d.program = nil
+	d.frameKeys = nil
+	d.hitFunction = ""
+	d.hitBreakpoints = nil
+	d.hitBinding = ""
+	d.hitValue = nil
+	d.depth = 0
+	d.instructions = 0
+	d.calls = nil
+	d.keepReturns = false
+	d.returnValue = nil
+	d.returnFrame = nil
+	d.limitErr = nil
+	d.cycleFrame = nil
+	d.cycleIp = 0
+	d.failedFrame = nil
+	d.failedAt = compiler.LocationData{}
+	d.operands = nil
+	d.state = NOT_STARTED
+	d.pauseReason = 0
+	d.result = nil
+}
+
+// Restart resets the driver and loads the program again, with the edits
+// made since the last run.
+func (d *Driver) Restart() error {
+	inline := d.SourceCode
+	if len(d.Files) > 0 {
+		inline = d.Files[0].Code
+	}
+	d.Reset()
+	if d.Source == "" {
+		return d.LoadSource(inline)
+	}
+	return d.Load(d.Source)
+}
+
 func (d *Driver) StartVM(sourceCode string) error {
 	lexer := lexer.New(sourceCode)
 	parser := parser.New(lexer)
 	program := parser.ParseProgram()
 	parserErrors := parser.Errors()
 	if len(parserErrors) > 0 {
+		d.logf("%d parser errors, first: %s", len(parserErrors), parserErrors[0])
 		d.Errors = append(d.Errors, parserErrors...)
+		d.setState(COMPILER_ERROR)
+		d.emit(Errored{Err: d.Errors[0], Location: d.FileLocation(d.Errors[0].Line())})
 		return d.Errors[0]
 	}
 	compiler := compiler.New()
 	err := compiler.Compile(program)
 	if err != nil {
+		d.logf("compiler error: %s", err)
 		d.Errors = append(d.Errors, err)
+		d.setState(COMPILER_ERROR)
+		d.emit(Errored{Err: err, Location: d.FileLocation(err.Line())})
 		return err
 	}
-	vm := vm.NewFromMain(compiler.MainFn(), compiler.Bytecode(), compiler.LocationMap, compiler.NameStore)
+	bytecode := compiler.Bytecode()
+	vm := vm.NewFromMain(compiler.MainFn(), bytecode, compiler.LocationMap, compiler.NameStore)
 	d.VM = vm
+	d.constants = bytecode.Constants
+	d.program = program
+	d.emit(Started{})
+	d.verifyBreakpoints()
 	return nil
 }
 
+// StepOver runs the program until it reaches another line in the same or
+// an outer function.
 func (d *Driver) StepOver() (error, bool) {
-	staringLoc := d.VM.SourceLocation()
+	if err := d.startRun(); err != nil {
+		return err, false
+	}
+	d.keepReturns = true
+	err, conditionMet := d.stepOver()
+	d.keepReturns = false
+	d.report(err, conditionMet, PausedAfterStep)
+	return err, conditionMet
+}
+
+// StepInto runs the program until it reaches another line or enters a
+// function.
+func (d *Driver) StepInto() (error, bool) {
+	if err := d.startRun(); err != nil {
+		return err, false
+	}
+	err, conditionMet := d.stepInto()
+	d.report(err, conditionMet, PausedAfterStep)
+	return err, conditionMet
+}
+
+// StepOut runs the program until the current function returns.
+func (d *Driver) StepOut() (error, bool) {
+	if err := d.startRun(); err != nil {
+		return err, false
+	}
+	d.keepReturns = true
+	err, conditionMet := d.stepOut()
+	d.keepReturns = false
+	d.report(err, conditionMet, PausedAfterStep)
+	return err, conditionMet
+}
+
+// RunWithBreakpoints runs the program until it reaches one of bps.
+func (d *Driver) RunWithBreakpoints(bps []breakpoint) (error, bool) {
+	if err := d.startRun(); err != nil {
+		return err, false
+	}
+	err, conditionMet := d.runWithBreakpoints(func() []breakpoint { return bps })
+	d.report(err, conditionMet, PausedOnBreakpoint)
+	return err, conditionMet
+}
+
+// Continue runs the program until it reaches one of the breakpoints of
+// the driver, including those set while it runs.
+func (d *Driver) Continue() (error, bool) {
+	if err := d.startRun(); err != nil {
+		return err, false
+	}
+	err, conditionMet := d.runWithBreakpoints(func() []breakpoint { return d.Breakpoints })
+	d.report(err, conditionMet, PausedOnBreakpoint)
+	return err, conditionMet
+}
+
+// RunUntilBreakPoint runs the program until it reaches line.
+func (d *Driver) RunUntilBreakPoint(line int) (error, bool) {
+	if err := d.startRun(); err != nil {
+		return err, false
+	}
+	err, conditionMet := d.runUntilLine(line)
+	d.report(err, conditionMet, PausedOnBreakpoint)
+	return err, conditionMet
+}
+
+func (d *Driver) stepOver() (error, bool) {
+	staringLoc := currentLocation(d.VM)
 	startingLine := staringLoc.Range.Start.Line
 	startingDepth := d.VM.CallDepth
 
 	runCondition := func(vm *vm.VM) (bool, exception.Exception) {
-		cycleLocation := vm.SourceLocation()
+		cycleLocation := currentLocation(vm)
 		cycleLine := cycleLocation.Range.Start.Line
 		cycleDepth := d.VM.CallDepth
 		if cycleLine != startingLine && cycleDepth <= startingDepth {
-			if !(d.State() == DONE) {
+			if !d.atEnd() {
 				vm.CurrentFrame().Ip--
 			}
 			return true, nil
@@ -153,23 +457,21 @@ func (d *Driver) StepOver() (error, bool) {
 		}
 	}
 
-	vm, err, conditonMet := d.VM.RunWithCondition(runCondition)
+	err, conditonMet := d.runWithCondition(runCondition)
 	if err != nil {
-		d.Errors = append(d.Errors, err)
 		return err, false
 	}
-	d.VM = vm
 	d.stoppedOnBreakpoint = false
 	return nil, conditonMet
 }
 
-func (d *Driver) StepInto() (error, bool) {
-	staringLoc := d.VM.SourceLocation()
+func (d *Driver) stepInto() (error, bool) {
+	staringLoc := currentLocation(d.VM)
 	startingLine := staringLoc.Range.Start.Line
 	startingDepth := d.VM.CallDepth
 
 	runCondition := func(vm *vm.VM) (bool, exception.Exception) {
-		cycleLocation := vm.SourceLocation()
+		cycleLocation := currentLocation(vm)
 		cycleLine := cycleLocation.Range.Start.Line
 		cycleDepth := d.VM.CallDepth
 
@@ -178,7 +480,7 @@ func (d *Driver) StepInto() (error, bool) {
 		if (cycleLine != startingLine && cycleDepth <= startingDepth) ||
 			// If we call StepInto on a line that has smth to step into
 			(cycleDepth > startingDepth) {
-			if !(d.State() == DONE) {
+			if !d.atEnd() {
 				vm.CurrentFrame().Ip--
 			}
 			return true, nil
@@ -187,24 +489,22 @@ func (d *Driver) StepInto() (error, bool) {
 		}
 	}
 
-	vm, err, conditonMet := d.VM.RunWithCondition(runCondition)
+	err, conditonMet := d.runWithCondition(runCondition)
 	if err != nil {
-		d.Errors = append(d.Errors, err)
 		return err, false
 	}
-	d.VM = vm
 	d.stoppedOnBreakpoint = false
 	return nil, conditonMet
 }
 
-func (d *Driver) StepOut() (error, bool) {
+func (d *Driver) stepOut() (error, bool) {
 	startingDepth := d.VM.CallDepth
 
 	runCondition := func(vm *vm.VM) (bool, exception.Exception) {
 		cycleDepth := d.VM.CallDepth
 
 		if cycleDepth < startingDepth {
-			if !(d.State() == DONE) {
+			if !d.atEnd() {
 				vm.CurrentFrame().Ip--
 			}
 			return true, nil
@@ -213,49 +513,85 @@ func (d *Driver) StepOut() (error, bool) {
 		}
 	}
 
-	vm, err, conditonMet := d.VM.RunWithCondition(runCondition)
+	err, conditonMet := d.runWithCondition(runCondition)
 	if err != nil {
-		d.Errors = append(d.Errors, err)
 		return err, false
 	}
-	d.VM = vm
 	d.stoppedOnBreakpoint = false
 	return nil, conditonMet
 }
-func (d *Driver) RunWithBreakpoints(bps []breakpoint) (error, bool) {
 
+// runWithBreakpoints runs the program until it reaches one of the
+// breakpoints that breakpoints returns before each instruction.
+func (d *Driver) runWithBreakpoints(breakpoints func() []breakpoint) (error, bool) {
+	// The line the program stopped on has to be left before its
+	// breakpoints are hit again. Functions called from it, and data
+	// breakpoints on it, are not skipped.
+	resumeLine := -1
+	var resumeFrame *vm.Frame
 	if d.stoppedOnBreakpoint {
-		d.StepOver()
+		resumeLine = currentLocation(d.VM).Range.Start.Line
+		resumeFrame = d.VM.CurrentFrame()
 	}
 
+	depth := d.VM.CallDepth
+	var writes []write
 	runCondition := func(vm *vm.VM) (bool, exception.Exception) {
-		executionLoc := vm.SourceLocation()
-		executionLine := executionLoc.Range.Start.Line
-		for _, bp := range bps {
-
-			if bp.line == executionLine {
-				d.stoppedOnBreakpoint = true
+		// Data breakpoints stop after the write, before the instruction
+		// that follows it.
+		if len(writes) > 0 && d.written(writes) {
+			vm.CurrentFrame().Ip--
+			return true, nil
+		}
+		writes = nil
+
+		entered := vm.CallDepth > depth
+		depth = vm.CallDepth
+		if entered {
+			if bp, ok := d.functionBreakpoint(vm.CurrentFrame().Name()); ok {
+				d.hitFunction = bp.name
+				d.hitBreakpoints = []int{bp.id}
 				vm.CurrentFrame().Ip--
 				return true, nil
 			}
 		}
+
+		executionLoc := currentLocation(vm)
+		executionLine := executionLoc.Range.Start.Line
+		resuming := false
+		if vm.CurrentFrame() == resumeFrame {
+			resuming = executionLine == resumeLine
+			if !resuming {
+				resumeFrame = nil
+			}
+		}
+		for _, bp := range breakpoints() {
+			if !resuming && d.isBreakpoint(bp, executionLine) {
+				d.hitBreakpoints = append(d.hitBreakpoints, bp.id)
+			}
+		}
+		if len(d.hitBreakpoints) > 0 {
+			d.stoppedOnBreakpoint = true
+			vm.CurrentFrame().Ip--
+			return true, nil
+		}
 		d.stoppedOnBreakpoint = false
+		writes = d.watchedWrites(vm)
 		return false, nil
 	}
 
-	vm, err, breakPointHit := d.VM.RunWithCondition(runCondition)
-	if err != nil {
-		d.Errors = append(d.Errors, err)
-		return err, false
+	err, conditionMet := d.runWithCondition(runCondition)
+	// The write of the last instruction has no next cycle to stop before,
+	// the program stops at its end.
+	if err == nil && !conditionMet && len(writes) > 0 && d.atEnd() && d.written(writes) {
+		return nil, true
 	}
-	d.VM = vm
-
-	return nil, breakPointHit
+	return err, conditionMet
 }
 
-func (d *Driver) RunUntilBreakPoint(line int) (error, bool) {
+func (d *Driver) runUntilLine(line int) (error, bool) {
 	runCondition := func(vm *vm.VM) (bool, exception.Exception) {
-		executionLoc := vm.SourceLocation()
+		executionLoc := currentLocation(vm)
 		executionLine := executionLoc.Range.Start.Line
 		if line == executionLine {
 			vm.CurrentFrame().Ip--
@@ -265,22 +601,204 @@ func (d *Driver) RunUntilBreakPoint(line int) (error, bool) {
 		}
 	}
 
-	vm, err, breakPointHit := d.VM.RunWithCondition(runCondition)
+	return d.runWithCondition(runCondition)
+}
+
+// PauseOnEntry pauses a program that was loaded but not run yet before
+// its first instruction.
+func (d *Driver) PauseOnEntry() error {
+	if d.VM == nil {
+		return errors.New("program is not loaded")
+	}
+	if d.state != NOT_STARTED {
+		return fmt.Errorf("program cannot be paused on entry in state=%s", d.state)
+	}
+	d.pause(PausedOnEntry)
+	d.emit(Paused{Reason: PausedOnEntry, Location: d.location()})
+	return nil
+}
+
+// CanGoto reports whether the paused program can continue at line of
+// source. Only lines of the function that is executing can be jumped to.
+func (d *Driver) CanGoto(source string, line int) bool {
+	_, ok := d.gotoTarget(source, line)
+	return ok
+}
+
+// Goto moves the paused program to the first instruction of line of
+// source, without executing the instructions in between.
+func (d *Driver) Goto(source string, line int) error {
+	if d.state != PAUSED {
+		return fmt.Errorf("program cannot jump in state=%s", d.state)
+	}
+	ip, ok := d.gotoTarget(source, line)
+	if !ok {
+		return fmt.Errorf("cannot jump to line %d of %s", line, source)
+	}
+	d.VM.CurrentFrame().Ip = ip - 1
+	d.stoppedOnBreakpoint = false
+	d.pause(PausedAfterGoto)
+	d.emit(Paused{Reason: PausedAfterGoto, Location: d.location()})
+	return nil
+}
+
+// gotoTarget returns the first instruction of line of source in the
+// function that is executing.
+func (d *Driver) gotoTarget(source string, line int) (int, bool) {
+	if d.VM == nil || d.state != PAUSED {
+		return 0, false
+	}
+	fn := d.VM.CurrentFrame().Closure().Fn
+	target := -1
+	for key, loc := range d.VM.LocationMap {
+		if key.ScopeId != fn || (target >= 0 && key.InstructionIndex >= target) {
+			continue
+		}
+		fileLoc := d.FileLocation(loc.Range.Start.Line)
+		if fileLoc.Line == line && (source == "" || fileLoc.Source == filepath.Clean(source)) {
+			target = key.InstructionIndex
+		}
+	}
+	return target, target >= 0
+}
+
+// Cancel stops the run in progress, or else the next run, before its next
+// instruction. The run returns ErrCancelled.
+func (d *Driver) Cancel() {
+	atomic.StoreInt32(&d.cancelled, 1)
+}
+
+// ClearCancel drops a Cancel that no run has stopped for yet.
+func (d *Driver) ClearCancel() {
+	atomic.StoreInt32(&d.cancelled, 0)
+}
+
+// instrument wraps runCondition with the hooks of the driver. The flag
+// reports that Cancel stopped the run.
+func (d *Driver) instrument(runCondition vm.RunCondition) (vm.RunCondition, *bool) {
+	executed := 0
+	cancelled := false
+
+	condition := func(vm *vm.VM) (bool, exception.Exception) {
+		d.observeCalls(vm)
+		if err := d.checkLimits(vm); err != nil {
+			d.limitErr = err
+			vm.CurrentFrame().Ip--
+			return true, nil
+		}
+		d.cycleFrame = vm.CurrentFrame()
+		d.cycleIp = vm.CurrentFrame().Ip
+		executed++
+		if d.OnCycle != nil {
+			d.OnCycle(executed)
+		}
+		if d.serveQueries != nil {
+			d.serveQueries()
+		}
+		if atomic.CompareAndSwapInt32(&d.cancelled, 1, 0) {
+			cancelled = true
+			vm.CurrentFrame().Ip--
+			return true, nil
+		}
+		stop, err := runCondition(vm)
+		if !stop && err == nil {
+			d.instructions++
+			if d.Profile != nil {
+				d.Profile.record(d, vm)
+			}
+			if d.Coverage != nil {
+				d.Coverage.record(d, vm)
+			}
+		}
+		return stop, err
+	}
+	return condition, &cancelled
+}
+
+func (d *Driver) runWithCondition(runCondition vm.RunCondition) (error, bool) {
+	condition, cancelled := d.instrument(runCondition)
+	vm, err, conditionMet := d.VM.RunWithCondition(condition)
+	d.VM = vm
+	if d.Profile != nil {
+		d.Profile.endRun(time.Now())
+	}
+	if d.limitErr != nil {
+		err = d.limitErr
+		d.limitErr = nil
+	} else if err != nil {
+		err = d.overflowError(d.VM, err)
+	}
+	if *cancelled {
+		d.logf("run cancelled at %v", currentLocation(d.VM))
+		return ErrCancelled, false
+	}
 	if err != nil {
+		d.logf("runtime error: %s", err)
 		d.Errors = append(d.Errors, err)
+		// A LimitError stops before the instruction already.
+		if _, limit := err.(LimitError); !limit && d.VM.CurrentFrame() == d.cycleFrame {
+			d.keepFailure()
+		}
 		return err, false
 	}
+	d.logf("run stopped at %v, condition met=%v", currentLocation(d.VM), conditionMet)
+	return nil, conditionMet
+}
 
-	d.VM = vm
-	return nil, breakPointHit
+func (d *Driver) logf(format string, args ...any) {
+	if d.Logf != nil {
+		d.Logf(format, args...)
+	}
 }
 
 func (d Driver) VMLocation() int {
 
-	loc := d.VM.SourceLocation()
+	loc := currentLocation(d.VM)
 	return loc.Range.End.Line
 }
 
+// atEnd reports whether the VM executed the last instruction of the
+// program.
+func (d *Driver) atEnd() bool {
+	return d.VM.State() == vm.DONE
+}
+
+// currentLocation returns the location of the next instruction of
+// machine, or no location if the program has ended.
+func currentLocation(machine *vm.VM) compiler.LocationData {
+	if machine.State() == vm.DONE {
+		return compiler.LocationData{}
+	}
+	f := machine.CurrentFrame()
+	return sourceLocation(machine, f, f.Ip)
+}
+
+// frameLocation returns the location of the instruction frame f of
+// machine executes.
+func frameLocation(machine *vm.VM, f *vm.Frame) compiler.LocationData {
+	if machine.CurrentInstructionIsPop() {
+		return sourceLocation(machine, f, f.Ip-1)
+	}
+	return sourceLocation(machine, f, f.Ip)
+}
+
+// sourceLocation returns the location of the instruction at ip in frame
+// f. The compiler only records the first instruction of an expression.
+func sourceLocation(machine *vm.VM, f *vm.Frame, ip int) compiler.LocationData {
+	fn := f.Closure().Fn
+	for i := ip; i <= len(f.Instructions()); i++ {
+		if loc, ok := machine.LocationMap[compiler.LocationKey{ScopeId: fn, InstructionIndex: i}]; ok {
+			return loc
+		}
+	}
+	for i := ip - 1; i >= 0; i-- {
+		if loc, ok := machine.LocationMap[compiler.LocationKey{ScopeId: fn, InstructionIndex: i}]; ok {
+			return loc
+		}
+	}
+	return compiler.LocationData{}
+}
+
 type DebugFrame struct {
 	Id     int
 	Name   string
@@ -288,21 +806,29 @@ type DebugFrame struct {
 	Line   int
 	Column int
 	Vars   []DriverVar
+	// Params are the arguments the function was called with.
+	Params   []DriverVar
+	Function *object.CompiledFunction
 }
 
 func (d Driver) NewDebugFrame(id int, vmFrame *vm.Frame) DebugFrame {
 	name := vmFrame.Name()
-	source := d.Source
-	loc := d.VM.SourceLocationInFrame(vmFrame)
-	line := loc.Range.Start.Line
+	loc := frameLocation(d.VM, vmFrame)
+	if vmFrame == d.failedFrame {
+		loc = d.failedAt
+	}
+	fileLoc := d.FileLocation(loc.Range.Start.Line)
+	source := fileLoc.Source
+	line := fileLoc.Line
 	col := loc.Range.Start.Col
 
 	return DebugFrame{
-		Id:     id,
-		Name:   name,
-		Source: source,
-		Line:   line,
-		Column: col,
+		Id:       id,
+		Name:     name,
+		Source:   source,
+		Line:     line,
+		Column:   col,
+		Function: vmFrame.Closure().Fn,
 	}
 }
 
@@ -316,7 +842,6 @@ func (d *Driver) CollectFrames() []DebugFrame {
 		if i == 0 {
 			debugFrame.Name = "main"
 		}
-		debugFrame.Source = d.Source
 
 		frameObjects, names := d.VM.ActiveObjects(*vmFrame)
 
@@ -325,7 +850,22 @@ func (d *Driver) CollectFrames() []DebugFrame {
 			name := names[obj]
 			frameVars[j] = ObjectToDriverVar(obj, name)
 		}
+		// The value returned by the call a step completed is shown first
+		// in the frame it returned to.
+		if vmFrame == d.returnFrame && i == numFrames-1 {
+			frameVars = append([]DriverVar{ObjectToDriverVar(d.returnValue, ReturnValueName)}, frameVars...)
+		}
+		// So are the operands of the instruction a failed program stopped
+		// on, in the frame that failed.
+		if i == numFrames-1 && len(d.operands) > 0 {
+			frameVars = append(append([]DriverVar{}, d.operands...), frameVars...)
+		}
 		debugFrame.Vars = frameVars
+		params := d.frameBindings(vmFrame)[:vmFrame.Closure().Fn.NumParameters]
+		debugFrame.Params = make([]DriverVar, len(params))
+		for j, b := range params {
+			debugFrame.Params[j] = ObjectToDriverVar(b.value, b.name)
+		}
 		debugFrames[i] = debugFrame
 
 	}
@@ -333,24 +873,32 @@ func (d *Driver) CollectFrames() []DebugFrame {
 	return debugFrames
 }
 
+// ReturnValueName is the name of the variable that holds the value that
+// the call completed by StepOver or StepOut returned.
+const ReturnValueName = "(return value)"
+
 type DriverVar struct {
-	Name               string
+	Name string
+	// Value is Object formatted with the default ValueFormat.
 	Value              string
 	Type               string
 	VariablesReference int
+	Object             object.Object
 }
 
 func ObjectToDriverVar(obj object.Object, name string) DriverVar {
 	v := DriverVar{
 		Name:               name,
+		Value:              FormatValue(obj, ValueFormat{}),
 		VariablesReference: 0,
+		Object:             obj,
 	}
-	switch obj := obj.(type) {
+	switch obj.(type) {
+	case nil:
+		v.Type = string(object.NULL_OBJ)
 	case *object.Closure:
-		v.Value = "function"
 		v.Type = "function"
 	default:
-		v.Value = obj.Inspect()
 		v.Type = string(obj.Type())
 	}
 	return v
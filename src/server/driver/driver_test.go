@@ -1,9 +1,21 @@
 package driver
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/moritz-tiesler/monkey/compiler"
+	"github.com/moritz-tiesler/monkey/object"
 	"github.com/moritz-tiesler/monkey/parser"
 	"github.com/moritz-tiesler/monkey/vm"
 )
@@ -949,3 +961,1320 @@ let d = 3;
 
 	}
 }
+
+type EvaluateTestCase struct {
+	sourceCode string
+	breakPoint breakpoint
+	frameId    int
+	expression string
+	expected   string
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []EvaluateTestCase{
+		{
+			sourceCode: `
+let a = 3
+let b = a + 1
+`,
+			breakPoint: breakpoint{line: 3},
+			expression: "a * 2",
+			expected:   "6",
+		},
+		{
+			sourceCode: `
+let square = fn(x) {
+	let res = x * x
+	return res
+}
+let t = true
+let f = true
+let z = square(4)
+`,
+			breakPoint: breakpoint{line: 4},
+			frameId:    1,
+			expression: "[res, x, t, f]",
+			expected:   "[16, 4, true, true]",
+		},
+		{
+			sourceCode: `
+let square = fn(x) {
+	return x * x
+}
+let z = square(4)
+let y = 2
+`,
+			breakPoint: breakpoint{line: 6},
+			expression: "[z].len() + square(z)",
+			expected:   "257",
+		},
+	}
+
+	for i, tt := range tests {
+		driver := New()
+		err := driver.StartVM(tt.sourceCode)
+		if err != nil {
+			t.Errorf("error starting VM: %s", err)
+		}
+		driver.RunUntilBreakPoint(tt.breakPoint.line)
+		actual, err := driver.Evaluate(tt.expression, tt.frameId)
+		if err != nil {
+			t.Errorf("error in evaluate test %d: %s", i+1, err)
+			continue
+		}
+		if actual.Inspect() != tt.expected {
+			t.Errorf("error in evaluate test %d", i+1)
+			t.Errorf("wrong result for %q: expected=%s, got=%s", tt.expression, tt.expected, actual.Inspect())
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	sourceCode := `
+let count = fn(n) {
+	if (n == 0) {
+		0
+	} else {
+		count(n - 1)
+	}
+};
+let inner = fn(k) {
+	if (k == 0) {
+		0
+	} else {
+		count(300);
+		inner(k - 1)
+	}
+};
+let outer = fn(k) {
+	if (k == 0) {
+		0
+	} else {
+		inner(100);
+		outer(k - 1)
+	}
+};
+outer(100);
+let done = 1;
+`
+	driver := New()
+	err := driver.StartVM(sourceCode)
+	if err != nil {
+		t.Errorf("error starting VM: %s", err)
+	}
+	driver.OnCycle = func(executed int) {
+		if executed == 1000 {
+			driver.Cancel()
+		}
+	}
+
+	err, hit := driver.RunWithBreakpoints([]breakpoint{{line: 26}})
+	if err != ErrCancelled || hit {
+		t.Fatalf("expected run to be cancelled, got err=%v, hit=%v", err, hit)
+	}
+	if driver.State() != PAUSED || driver.PauseReason() != PausedByCancel {
+		t.Errorf("expected state=%s after cancelling, got=%s %s", PAUSED, driver.State(), driver.PauseReason())
+	}
+
+	// Evaluations do not report their cycles, a Cancel stops them all the
+	// same.
+	cycles := 0
+	driver.OnCycle = func(executed int) {
+		cycles++
+	}
+	driver.Cancel()
+	_, err = driver.Evaluate("outer(100)", 0)
+	if err != ErrCancelled {
+		t.Errorf("expected evaluation to be cancelled, got err=%v", err)
+	}
+	if _, err := driver.Evaluate("inner(2)", 0); err != nil || cycles != 0 {
+		t.Errorf("expected evaluation without cycles, got err=%v cycles=%d", err, cycles)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restart.mky")
+	sourceCode := `
+let x = 4;
+let y = 2;
+let z = x();
+`
+	err := os.WriteFile(path, []byte(sourceCode), 0644)
+	if err != nil {
+		t.Fatalf("could not write program: %s", err)
+	}
+
+	driver := New()
+	driver.SetBreakPoints([]int{3})
+	err = driver.Load(path)
+	if err != nil {
+		t.Fatalf("error loading program: %s", err)
+	}
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if driver.State() != RUNTIME_ERROR {
+		t.Fatalf("expected state=%s, got=%s", RUNTIME_ERROR, driver.State())
+	}
+
+	fixed := strings.Replace(sourceCode, "x()", "x", 1)
+	err = os.WriteFile(path, []byte(fixed), 0644)
+	if err != nil {
+		t.Fatalf("could not write program: %s", err)
+	}
+	err = driver.Restart()
+	if err != nil {
+		t.Fatalf("error restarting program: %s", err)
+	}
+	if driver.HasErrors() || driver.Frames != nil {
+		t.Errorf("expected state of previous run to be discarded, got errors=%v", driver.Errors)
+	}
+	if driver.SourceCode != fixed {
+		t.Errorf("expected program to be read again, got=%s", driver.SourceCode)
+	}
+
+	err, hit := driver.RunWithBreakpoints(driver.Breakpoints)
+	if err != nil || !hit {
+		t.Fatalf("expected to hit kept breakpoint, got err=%v, hit=%v", err, hit)
+	}
+	line := driver.VM.SourceLocation().Range.Start.Line
+	if line != 3 {
+		t.Errorf("wrong breakpoint line after restart: expected line=3, got line=%d", line)
+	}
+	// The operands of the failed run are gone.
+	for _, v := range driver.CollectFrames()[0].Vars {
+		if strings.HasPrefix(v.Name, OperandPrefix) {
+			t.Errorf("expected no operands after restart, got %s", v.Name)
+		}
+	}
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if driver.State() != EXITED {
+		t.Errorf("expected state=%s, got=%s", EXITED, driver.State())
+	}
+
+	// A step of the previous run is not reported after a restart.
+	stepping := `let f = fn() {
+	let a = 1;
+	a
+};
+let b = f();
+let c = f();
+`
+	driver = New()
+	driver.SetBreakPoints([]int{2})
+	err = driver.LoadSource(stepping)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	driver.StepOut()
+	frames := driver.CollectFrames()
+	if vars := frames[0].Vars; len(vars) == 0 || vars[0].Name != ReturnValueName {
+		t.Fatalf("expected the return value after step out, got=%v", vars)
+	}
+
+	err = driver.Restart()
+	if err != nil {
+		t.Fatalf("error restarting program: %s", err)
+	}
+	if driver.keepReturns || driver.returnValue != nil || driver.returnFrame != nil || driver.pauseReason != PausedOnBreakpoint {
+		t.Errorf("expected the step of the previous run to be discarded")
+	}
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if reason := driver.PauseReason(); reason != PausedOnBreakpoint {
+		t.Errorf("expected pause reason=%s, got=%s", PausedOnBreakpoint, reason)
+	}
+	frames = driver.CollectFrames()
+	for _, v := range frames[len(frames)-1].Vars {
+		if v.Name == ReturnValueName {
+			t.Errorf("expected no return value after restart, got=%s", v.Value)
+		}
+	}
+}
+
+func TestImports(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.mky": `let x = 2;
+import("lib/square.mky");
+import("lib/square.mky");
+let y = square(x);
+let z = y;
+`,
+		"lib/square.mky": `import("double.mky");
+let square = fn(a) {
+	let b = a * a;
+	double(b)
+};
+`,
+		"lib/double.mky": `let double = fn(n) {
+	n + n
+};
+`,
+	}
+	for name, code := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := os.WriteFile(path, []byte(code), 0644)
+		if err != nil {
+			t.Fatalf("could not write program: %s", err)
+		}
+	}
+	mainPath := filepath.Join(dir, "main.mky")
+	squarePath := filepath.Join(dir, "lib", "square.mky")
+	doublePath := filepath.Join(dir, "lib", "double.mky")
+
+	driver := New()
+	driver.SetBreakPointsInSource(squarePath, []int{3})
+	driver.SetBreakPointsInSource(doublePath, []int{2})
+	driver.SetBreakPointsInSource(mainPath, []int{5})
+	err := driver.Load(mainPath)
+	if err != nil {
+		t.Fatalf("error loading program: %s", err)
+	}
+
+	if len(driver.Files) != 3 {
+		t.Fatalf("expected 3 files, got=%d", len(driver.Files))
+	}
+
+	expectedHits := []Location{
+		{Source: squarePath, Line: 3},
+		{Source: doublePath, Line: 2},
+		{Source: mainPath, Line: 5},
+	}
+	for i, expected := range expectedHits {
+		err, hit := driver.RunWithBreakpoints(driver.Breakpoints)
+		if err != nil || !hit {
+			t.Fatalf("expected to hit breakpoint %d, got err=%v, hit=%v", i+1, err, hit)
+		}
+		frames := driver.CollectFrames()
+		top := frames[len(frames)-1]
+		actual := Location{Source: top.Source, Line: top.Line}
+		if actual != expected {
+			t.Errorf("wrong breakpoint location: expected=%v, got=%v", expected, actual)
+		}
+	}
+
+	frames := driver.CollectFrames()
+	if frames[0].Source != mainPath {
+		t.Errorf("wrong source of main frame: expected=%s, got=%s", mainPath, frames[0].Source)
+	}
+
+	err = os.Remove(doublePath)
+	if err != nil {
+		t.Fatalf("could not remove file: %s", err)
+	}
+	err = driver.Restart()
+	importErr, ok := err.(ImportError)
+	if !ok {
+		t.Fatalf("expected import error, got=%T", err)
+	}
+	loc := driver.FileLocation(importErr.Line())
+	if loc.Source != squarePath || loc.Line != 1 {
+		t.Errorf("wrong location of import error: expected=%s:1, got=%v", squarePath, loc)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	// The program makes 2^60 calls, but never nests more than 60 of them,
+	// so it runs until it is cancelled.
+	sourceCode := `
+let double = fn(n) {
+	if (n == 0) {
+		0
+	} else {
+		double(n - 1) + double(n - 1)
+	}
+};
+double(60);
+`
+	runner := NewRunner(New())
+	defer runner.Close()
+
+	started := make(chan struct{})
+	runner.Do(func(d *Driver) {
+		err := d.StartVM(sourceCode)
+		if err != nil {
+			t.Errorf("error starting VM: %s", err)
+		}
+		d.OnCycle = func(executed int) {
+			if executed == 1 {
+				close(started)
+			}
+		}
+	})
+
+	done := make(chan error)
+	go func() {
+		runner.Do(func(d *Driver) {
+			err, _ := d.RunWithBreakpoints(nil)
+			done <- err
+		})
+	}()
+
+	<-started
+	// Queries are answered while the program runs.
+	for i := 0; i < 10; i++ {
+		var frames []DebugFrame
+		runner.Query(func(d *Driver) {
+			frames = d.CollectFrames()
+		})
+		if len(frames) == 0 {
+			t.Fatalf("expected frames of the running program")
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("expected the program to be running, it returned err=%v", err)
+		default:
+		}
+	}
+
+	runner.Cancel()
+	if err := <-done; err != ErrCancelled {
+		t.Errorf("expected the run to be cancelled, got=%v", err)
+	}
+
+	// Panics are raised in the goroutine that submitted the command.
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("expected the panic of the command, got=%v", r)
+		}
+	}()
+	runner.Do(func(d *Driver) {
+		panic("boom")
+	})
+}
+
+func TestSetBreakpointsWhileRunning(t *testing.T) {
+	sourceCode := `
+let count = fn(n) {
+	if (n == 0) {
+		0
+	} else {
+		count(n - 1)
+	}
+};
+let loop = fn(k) {
+	if (k == 0) {
+		0
+	} else {
+		count(500);
+		loop(k - 1)
+	}
+};
+loop(100000);
+`
+	runner := NewRunner(New())
+	defer runner.Close()
+
+	started := make(chan struct{})
+	runner.Do(func(d *Driver) {
+		err := d.StartVM(sourceCode)
+		if err != nil {
+			t.Errorf("error starting VM: %s", err)
+		}
+		d.OnCycle = func(executed int) {
+			if executed == 1 {
+				close(started)
+			}
+		}
+	})
+
+	type result struct {
+		err error
+		hit bool
+	}
+	done := make(chan result)
+	go func() {
+		runner.Do(func(d *Driver) {
+			err, hit := d.Continue()
+			done <- result{err, hit}
+		})
+	}()
+
+	<-started
+	runner.Query(func(d *Driver) {
+		d.SetBreakPoints([]int{4})
+	})
+	if r := <-done; r.err != nil || !r.hit {
+		t.Fatalf("expected the run to stop on the breakpoint set while running, got err=%v hit=%v", r.err, r.hit)
+	}
+	runner.Do(func(d *Driver) {
+		if line := d.CollectFrames()[d.VM.FramesIndex()-1].Line; line != 4 {
+			t.Errorf("expected to stop at line 4, got=%d", line)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	sourceCode := `let square = fn(x) {
+	let res = x * x;
+	return res;
+};
+let z = square(3);
+let w = z + 1;
+`
+	driver := New()
+	var events []Event
+	driver.Subscribe(func(e Event) {
+		events = append(events, e)
+	})
+
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.RunWithBreakpoints([]breakpoint{{line: 2}})
+	driver.StepOver()
+	driver.RunWithBreakpoints(nil)
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got=%d: %#v", len(events), events)
+	}
+	if _, ok := events[0].(Started); !ok {
+		t.Errorf("expected Started, got=%#v", events[0])
+	}
+	if e, ok := events[1].(StoppedOnBreakpoint); !ok || e.Location.Line != 2 {
+		t.Errorf("expected StoppedOnBreakpoint on line 2, got=%#v", events[1])
+	}
+	if e, ok := events[2].(StepCompleted); !ok || e.Location.Line != 3 {
+		t.Errorf("expected StepCompleted on line 3, got=%#v", events[2])
+	}
+	e, ok := events[3].(Exited)
+	if !ok || e.Value == nil || e.Value.Inspect() != "10" {
+		t.Errorf("expected Exited with value 10, got=%#v", events[3])
+	}
+
+	events = nil
+	driver.Reset()
+	err = driver.LoadSource("let x = ;")
+	if err == nil {
+		t.Fatalf("expected a parser error")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got=%d: %#v", len(events), events)
+	}
+	if _, ok := events[0].(Errored); !ok {
+		t.Errorf("expected Errored, got=%#v", events[0])
+	}
+}
+
+func TestStates(t *testing.T) {
+	driver := New()
+	if driver.State() != NOT_STARTED {
+		t.Fatalf("expected state=%s before loading, got=%s", NOT_STARTED, driver.State())
+	}
+
+	err := driver.LoadSource(`let square = fn(x) {
+	x * x
+};
+let a = square(2);
+square(a) + 1
+`)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	if driver.State() != NOT_STARTED {
+		t.Fatalf("expected state=%s after loading, got=%s", NOT_STARTED, driver.State())
+	}
+
+	var states []State
+	driver.OnCycle = func(executed int) {
+		if executed == 1 {
+			states = append(states, driver.State())
+		}
+	}
+	driver.RunWithBreakpoints([]breakpoint{{line: 2}})
+	if driver.State() != PAUSED || driver.PauseReason() != PausedOnBreakpoint {
+		t.Errorf("expected state=%s on a breakpoint, got=%s %s", PAUSED, driver.State(), driver.PauseReason())
+	}
+	driver.StepOut()
+	if driver.State() != PAUSED || driver.PauseReason() != PausedAfterStep {
+		t.Errorf("expected state=%s after a step, got=%s %s", PAUSED, driver.State(), driver.PauseReason())
+	}
+	driver.RunWithBreakpoints(nil)
+	if driver.State() != EXITED || driver.ExitCode() != 0 {
+		t.Fatalf("expected state=%s with exit code 0, got=%s %d", EXITED, driver.State(), driver.ExitCode())
+	}
+	if driver.Result() == nil || driver.Result().Inspect() != "17" {
+		t.Errorf("expected result 17, got=%v", driver.Result())
+	}
+	for _, s := range states {
+		if s != RUNNING {
+			t.Errorf("expected state=%s while running, got=%s", RUNNING, s)
+		}
+	}
+
+	err, _ = driver.StepOver()
+	if err == nil || driver.State() != EXITED {
+		t.Errorf("expected stepping an exited program to fail, got err=%v state=%s", err, driver.State())
+	}
+
+	driver.Reset()
+	err = driver.LoadSource("let x = ;")
+	if err == nil || driver.State() != COMPILER_ERROR || driver.ExitCode() != 1 {
+		t.Errorf("expected state=%s with exit code 1, got=%s %d", COMPILER_ERROR, driver.State(), driver.ExitCode())
+	}
+
+	driver.Reset()
+	driver.LoadSource(`let f = fn() { 1 + true };
+f();
+`)
+	driver.RunWithBreakpoints(nil)
+	if driver.State() != RUNTIME_ERROR || driver.ExitCode() != 1 {
+		t.Errorf("expected state=%s with exit code 1, got=%s %d", RUNTIME_ERROR, driver.State(), driver.ExitCode())
+	}
+}
+
+func TestBreakpointPlacement(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "placement.mky")
+	sourceCode := `let square = fn(x) {
+	x * x
+};
+
+let a = square(2);
+let b = a + 1;
+`
+	err := os.WriteFile(path, []byte(sourceCode), 0644)
+	if err != nil {
+		t.Fatalf("could not write program: %s", err)
+	}
+
+	driver := New()
+	var changed []Breakpoint
+	driver.Subscribe(func(e Event) {
+		if e, ok := e.(BreakpointChanged); ok {
+			changed = append(changed, e.Breakpoint)
+		}
+	})
+	set := driver.SetBreakPointsInSource(path, []int{4, 6})
+	if set[0].Line != 4 || !set[0].Verified {
+		t.Errorf("expected breakpoint to stay on line 4 before loading, got=%+v", set[0])
+	}
+	functions := driver.SetFunctionBreakpoints([]string{"square", "cube"})
+
+	err = driver.Load(path)
+	if err != nil {
+		t.Fatalf("error loading program: %s", err)
+	}
+	expected := []Breakpoint{
+		{Id: set[0].Id, Source: path, Line: 5, Verified: true},
+		{Id: functions[1].Id, Function: "cube", Message: "no function with this name"},
+	}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("wrong breakpoint changes after loading:\nexpected=%+v\ngot=%+v", expected, changed)
+	}
+
+	again := driver.SetBreakPointsInSource(path, []int{2, 6, 4})
+	if again[1].Id != set[1].Id || again[2].Id != set[0].Id {
+		t.Errorf("expected breakpoints on the same lines to keep their ids, got=%+v before=%+v", again, set)
+	}
+	if again[0].Id == set[0].Id || again[0].Id == set[1].Id || again[0].Id == functions[0].Id {
+		t.Errorf("expected a new id for a new breakpoint, got=%+v", again[0])
+	}
+
+	err, hit := driver.RunWithBreakpoints(nil)
+	if err != nil || !hit {
+		t.Fatalf("expected to hit a breakpoint, got err=%v, hit=%v", err, hit)
+	}
+	if driver.hitFunction != "square" || !reflect.DeepEqual(driver.hitBreakpoints, []int{functions[0].Id}) {
+		t.Errorf("expected to stop on function breakpoint=%d, got=%v", functions[0].Id, driver.hitBreakpoints)
+	}
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if !reflect.DeepEqual(driver.hitBreakpoints, []int{again[0].Id}) {
+		t.Errorf("expected to stop on breakpoint=%d, got=%v", again[0].Id, driver.hitBreakpoints)
+	}
+
+	edited := "let a = 1;\nlet b = a + 1;\n"
+	err = os.WriteFile(path, []byte(edited), 0644)
+	if err != nil {
+		t.Fatalf("could not write program: %s", err)
+	}
+	changed = nil
+	err = driver.Restart()
+	if err != nil {
+		t.Fatalf("error restarting program: %s", err)
+	}
+	expected = []Breakpoint{
+		{Id: again[1].Id, Source: path, Line: 6, Verified: false, Message: "no code on or after this line"},
+		{Id: again[2].Id, Source: path, Line: 4, Verified: false, Message: "no code on or after this line"},
+		{Id: functions[0].Id, Function: "square", Message: "no function with this name"},
+	}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("wrong breakpoint changes after an edit:\nexpected=%+v\ngot=%+v", expected, changed)
+	}
+}
+
+func TestDataBreakpoints(t *testing.T) {
+	sourceCode := `let count = 1;
+let bump = fn(x) {
+	let y = x + 1;
+	let y = x * 2;
+	y
+};
+let next = bump(count);
+let count = next;
+let count = 2;
+let count = if (false) { 1 };
+count;
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.SetBreakPoints([]int{2, 4})
+
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	_, _, ok := driver.DataBreakpointInfo(0, "bump")
+	if ok {
+		t.Errorf("expected no data id for a binding that is not set yet")
+	}
+	dataId, description, ok := driver.DataBreakpointInfo(0, "count")
+	if !ok || dataId != "global:count" || description != "global count" {
+		t.Fatalf("wrong data breakpoint info for count: %q %q %v", dataId, description, ok)
+	}
+	set := driver.SetDataBreakpoints([]DataBreakpoint{
+		{DataId: dataId, Condition: "changed"},
+		{DataId: dataId, Condition: "x > 1"},
+	})
+	if !set[0].Verified || set[1].Verified || set[1].Message == "" {
+		t.Errorf("expected only the breakpoint without a condition to be verified, got=%+v", set)
+	}
+
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if driver.PauseReason() != PausedOnBreakpoint || driver.location().Line != 4 {
+		t.Fatalf("expected to stop on line 4, got=%s on line %d", driver.PauseReason(), driver.location().Line)
+	}
+	dataId, description, ok = driver.DataBreakpointInfo(1, "y")
+	if !ok || description != "y in bump" {
+		t.Fatalf("wrong data breakpoint info for y: %q %q %v", dataId, description, ok)
+	}
+	local := driver.SetDataBreakpoints([]DataBreakpoint{
+		{DataId: "global:count", Condition: "changed"},
+		{DataId: dataId},
+	})
+	if local[0].Id != set[0].Id || !local[1].Verified {
+		t.Errorf("expected the global breakpoint to keep its id and the local one to be verified, got=%+v", local)
+	}
+	driver.SetBreakPoints(nil)
+
+	var events []StoppedOnBreakpoint
+	driver.Subscribe(func(e Event) {
+		if e, ok := e.(StoppedOnBreakpoint); ok {
+			events = append(events, e)
+		}
+	})
+	for driver.State() == PAUSED {
+		driver.RunWithBreakpoints(driver.Breakpoints)
+	}
+	if driver.State() != EXITED {
+		t.Fatalf("expected the program to exit, got=%s", driver.State())
+	}
+
+	expected := []struct {
+		id      int
+		binding string
+		value   string
+		line    int
+	}{
+		{local[1].Id, "y", "2", 5},
+		{local[0].Id, "count", "2", 9},
+		{local[0].Id, "count", "null", 11},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d stops, got=%d: %+v", len(expected), len(events), events)
+	}
+	for i, e := range expected {
+		got := events[i]
+		if len(got.Ids) != 1 || got.Ids[0] != e.id || got.Binding != e.binding || got.Value.Inspect() != e.value || got.Location.Line != e.line {
+			t.Errorf("wrong stop %d: expected=%+v, got=%+v", i, e, got)
+		}
+	}
+}
+
+func TestDataBreakpointOnLastStatement(t *testing.T) {
+	sourceCode := `let count = 1;
+let count = 2;
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.SetBreakPoints([]int{2})
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	set := driver.SetDataBreakpoints([]DataBreakpoint{{DataId: "global:count"}})
+	driver.SetBreakPoints(nil)
+
+	var stops []StoppedOnBreakpoint
+	driver.Subscribe(func(e Event) {
+		if e, ok := e.(StoppedOnBreakpoint); ok {
+			stops = append(stops, e)
+		}
+	})
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if driver.State() != PAUSED || driver.PauseReason() != PausedOnDataBreakpoint {
+		t.Fatalf("expected to stop on the write of the last statement, got=%s %s", driver.State(), driver.PauseReason())
+	}
+	if len(stops) != 1 || stops[0].Ids[0] != set[0].Id || stops[0].Value.Inspect() != "2" || stops[0].Location.Line != 2 {
+		t.Errorf("wrong stop: %+v", stops)
+	}
+
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	if driver.State() != EXITED || len(stops) != 1 {
+		t.Errorf("expected the program to exit, got=%s after %d stops", driver.State(), len(stops))
+	}
+}
+
+func TestResumeFromBreakpoint(t *testing.T) {
+	sourceCode := `let countdown = fn(n) {
+	if (n == 0) { return 0; }
+	countdown(n - 1)
+};
+countdown(2);
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.SetBreakPoints([]int{2})
+
+	depths := []int{}
+	for {
+		driver.RunWithBreakpoints(driver.Breakpoints)
+		if driver.State() != PAUSED {
+			break
+		}
+		depths = append(depths, driver.VM.CallDepth)
+	}
+	if !reflect.DeepEqual(depths, []int{1, 2, 3}) {
+		t.Errorf("expected to stop in every recursive call, got depths=%v", depths)
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	sourceCode := `let numbers = [1, 2];
+let name = "monkey";
+let add = fn(a, b) { a + b };
+let scale = fn(factor) {
+	let result = factor * 2;
+	result
+};
+scale(3);
+`
+	driver := New()
+	start, completions := driver.Completions(0, "pu", 2)
+	if start != 0 || len(completions) != 2 || completions[0].Label != "puts" || completions[1].Label != "push" {
+		t.Errorf("expected builtins to be completed without a program, got=%d %+v", start, completions)
+	}
+
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.RunWithBreakpoints([]breakpoint{{line: 6}})
+
+	tests := []struct {
+		frameId  int
+		text     string
+		start    int
+		expected []string
+	}{
+		{1, "re", 0, []string{"result variable INTEGER", "rest function fn(arr)"}},
+		{1, "f", 0, []string{"factor variable INTEGER", "first function fn(arr)"}},
+		{0, "f", 0, []string{"first function fn(arr)"}},
+		{1, "sc", 0, []string{"scale function fn(factor)"}},
+		{0, "len(nu", 4, []string{"numbers variable ARRAY"}},
+		{1, "numbers.l", 8, []string{"len method fn(arg)", "last method fn(arr)"}},
+		{1, "name.", 5, []string{"add method fn(a, b)", "scale method fn(factor)", "len method fn(arg)", "puts method fn(...args)"}},
+		{1, "zzz", 0, []string{}},
+	}
+	for _, tt := range tests {
+		start, completions := driver.Completions(tt.frameId, tt.text, len(tt.text))
+		got := make([]string, len(completions))
+		for i, c := range completions {
+			got[i] = fmt.Sprintf("%s %s %s", c.Label, c.Kind, c.Detail)
+		}
+		if start != tt.start || !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("wrong completions of %q in frame %d: expected=%d %v, got=%d %v", tt.text, tt.frameId, tt.start, tt.expected, start, got)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	array := &object.Array{}
+	for i := 0; i < 1000; i++ {
+		array.Elements = append(array.Elements, &object.Integer{Value: int64(i)})
+	}
+	hash := &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+	for _, k := range []int64{10, 2, 1} {
+		key := &object.Integer{Value: k}
+		hash.Pairs[key.HashKey()] = object.HashPair{Key: key, Value: &object.String{Value: "v"}}
+	}
+	bigHash := &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+	for i := int64(999); i >= 0; i-- {
+		key := &object.Integer{Value: i}
+		bigHash.Pairs[key.HashKey()] = object.HashPair{Key: key, Value: &object.String{Value: "v"}}
+	}
+
+	tests := []struct {
+		value    object.Object
+		format   ValueFormat
+		expected string
+	}{
+		{&object.Integer{Value: 255}, ValueFormat{}, "255"},
+		{&object.Integer{Value: 255}, ValueFormat{Hex: true}, "0xff"},
+		{&object.Integer{Value: -16}, ValueFormat{Hex: true}, "-0x10"},
+		{&object.String{Value: "a\t\"b\"\n"}, ValueFormat{}, `"a\t\"b\"\n"`},
+		{&object.String{Value: "äöü"}, ValueFormat{MaxLength: 3}, `"äö…`},
+		{&object.Closure{}, ValueFormat{}, "function"},
+		{nil, ValueFormat{}, "null"},
+		{hash, ValueFormat{}, `{1: "v", 2: "v", 10: "v"}`},
+		{array, ValueFormat{MaxLength: 12}, "[0, 1, 2, 3,…"},
+		{array, ValueFormat{Hex: true, MaxLength: 20}, "[0x0, 0x1, 0x2, 0x3,…"},
+		{&object.Array{Elements: []object.Object{array}}, ValueFormat{MaxLength: 6}, "[[0, 1…"},
+		{bigHash, ValueFormat{MaxLength: 20}, `{0: "v", 1: "v", 2: …`},
+		{bigHash, ValueFormat{MaxLength: 24}, `{0: "v", 1: "v", 2: "v",…`},
+	}
+	for _, tt := range tests {
+		got := FormatValue(tt.value, tt.format)
+		if got != tt.expected {
+			t.Errorf("wrong format of %v with %+v: expected=%s, got=%s", tt.value, tt.format, tt.expected, got)
+		}
+	}
+
+	got := FormatValue(array, ValueFormat{})
+	if n := utf8.RuneCountInString(got); n != DefaultMaxValueLength+1 || !strings.HasSuffix(got, "…") {
+		t.Errorf("expected long values to be cut off after %d characters, got %d", DefaultMaxValueLength, n)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	sourceCode := `let square = fn(x) {
+	x * x
+};
+let sum = fn(a, b) {
+	square(a) +
+		square(b)
+};
+let total = sum(1, 2);
+puts(total);
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	entries := []TraceEntry{}
+	driver.Trace = func(entry TraceEntry) {
+		entries = append(entries, entry)
+	}
+	driver.SetBreakPoints([]int{2})
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	// Expressions evaluated while paused are not traced.
+	if _, err := driver.Evaluate("square(5)", 0); err != nil {
+		t.Fatalf("error evaluating: %s", err)
+	}
+	driver.SetBreakPoints(nil)
+	driver.RunWithBreakpoints(driver.Breakpoints)
+
+	arg := func(name, value string) []TraceArgument {
+		return []TraceArgument{{Name: name, Value: value}}
+	}
+	expected := []TraceEntry{
+		{Kind: "call", Function: "sum", Depth: 1, Line: 8, Arguments: []TraceArgument{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, Instruction: 8},
+		{Kind: "call", Function: "square", Depth: 2, Line: 5, Arguments: arg("x", "1"), Instruction: 11},
+		{Kind: "return", Function: "square", Depth: 2, Line: 5, Value: "1", Instructions: 4, Instruction: 15},
+		{Kind: "call", Function: "square", Depth: 2, Line: 6, Arguments: arg("x", "2"), Instruction: 18},
+		{Kind: "return", Function: "square", Depth: 2, Line: 6, Value: "4", Instructions: 4, Instruction: 22},
+		{Kind: "return", Function: "sum", Depth: 1, Line: 8, Value: "5", Instructions: 16, Instruction: 24},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("wrong trace.\nexpected=%+v\ngot=%+v", expected, entries)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	sourceCode := `let square = fn(x) {
+	x * x
+};
+let sum = fn(a, b) {
+	square(a) +
+		square(b)
+};
+let total = sum(1, 2);
+total;
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.Profile = NewProfile()
+	driver.SetBreakPoints([]int{2})
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	driver.SetBreakPoints(nil)
+	driver.RunWithBreakpoints(driver.Breakpoints)
+
+	// Lines count the instructions of the functions they call.
+	expected := map[Location]int64{
+		{Line: 1}: 2,
+		{Line: 2}: 8,
+		{Line: 4}: 2,
+		{Line: 5}: 9,
+		{Line: 6}: 7,
+		{Line: 8}: 21,
+		{Line: 9}: 2,
+	}
+	if actual := driver.Profile.Instructions(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("wrong instructions per line.\nexpected=%v\ngot=%v", expected, actual)
+	}
+
+	var out bytes.Buffer
+	if err := driver.Profile.Write(&out); err != nil {
+		t.Fatalf("error writing profile: %s", err)
+	}
+	r, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatalf("profile is not gzipped: %s", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error reading profile: %s", err)
+	}
+	for _, name := range []string{"main", "sum", "square", "instructions", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(name)) {
+			t.Errorf("expected %q in the string table of the profile", name)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	sourceCode := `let sign = fn(x) {
+	if (x < 0) {
+		-1
+	} else {
+		1
+	}
+};
+let unused = fn() {
+	let zero = 0;
+
+	zero
+};
+sign(2);
+sign(3);
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.Coverage = NewCoverage()
+	driver.SetBreakPoints([]int{5})
+	driver.RunWithBreakpoints(driver.Breakpoints)
+	driver.SetBreakPoints(nil)
+	driver.RunWithBreakpoints(driver.Breakpoints)
+
+	// Lines are counted once per call, the if line is entered again when
+	// the function returns.
+	expectedLines := map[Location]int{
+		{Line: 1}: 1, {Line: 2}: 2, {Line: 3}: 0, {Line: 5}: 2,
+		{Line: 8}: 1, {Line: 9}: 0, {Line: 11}: 0,
+		{Line: 13}: 1, {Line: 14}: 1,
+	}
+	if lines := driver.Coverage.Lines(); !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("wrong lines.\nexpected=%v\ngot=%v", expectedLines, lines)
+	}
+	expectedSummary := "Covered 6 of 9 lines (66.7%). Not covered: line 3, line 9-11"
+	if summary := driver.Coverage.Summary(); summary != expectedSummary {
+		t.Errorf("wrong summary.\nexpected=%q\ngot=%q", expectedSummary, summary)
+	}
+
+	var out strings.Builder
+	if err := driver.Coverage.WriteLCOV(&out); err != nil {
+		t.Fatalf("error writing LCOV: %s", err)
+	}
+	expectedLCOV := `TN:
+SF:
+FN:1,sign
+FN:8,unused
+FNDA:2,sign
+FNDA:0,unused
+FNF:2
+FNH:1
+DA:1,1
+DA:2,2
+DA:3,0
+DA:5,2
+DA:8,1
+DA:9,0
+DA:11,0
+DA:13,1
+DA:14,1
+LF:9
+LH:6
+end_of_record
+`
+	if out.String() != expectedLCOV {
+		t.Errorf("wrong LCOV.\nexpected=%s\ngot=%s", expectedLCOV, out.String())
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	sourceCode := `let countdown = fn(n) {
+	if (n == 0) { return 0; }
+	countdown(n - 1)
+};
+let fail = fn() { countdown(1) + "a" };
+fail();
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	timeline := NewTimeline()
+	driver.Trace = timeline.Add
+	driver.RunWithBreakpoints(nil)
+	if driver.State() != RUNTIME_ERROR {
+		t.Fatalf("expected the program to fail, got state=%s", driver.State())
+	}
+
+	var out bytes.Buffer
+	if err := timeline.Write(&out); err != nil {
+		t.Fatalf("error writing timeline: %s", err)
+	}
+	var written struct {
+		TraceEvents []struct {
+			Name  string         `json:"name"`
+			Phase string         `json:"ph"`
+			Time  int            `json:"ts"`
+			Args  map[string]any `json:"args"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &written); err != nil {
+		t.Fatalf("timeline is not JSON: %s", err)
+	}
+	events := []string{}
+	for _, e := range written.TraceEvents {
+		events = append(events, fmt.Sprintf("%s %s %d", e.Phase, e.Name, e.Time))
+	}
+	// fail never returns, it ends with the last call.
+	expected := []string{"B fail 6", "B countdown 9", "B countdown 20", "E countdown 26", "E countdown 27", "E  27"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("wrong events.\nexpected=%v\ngot=%v", expected, events)
+	}
+	args := map[string]any{"n": "1", "call site": "line 5"}
+	if !reflect.DeepEqual(written.TraceEvents[1].Args, args) {
+		t.Errorf("wrong arguments.\nexpected=%v\ngot=%v", args, written.TraceEvents[1].Args)
+	}
+}
+
+func TestReturnValue(t *testing.T) {
+	sourceCode := `let square = fn(x) {
+	let y = x * x;
+	y
+};
+let run = fn() {
+	let a = square(2);
+	let b = square(3);
+	a + b
+};
+let total = run();
+total;
+`
+	driver := New()
+	err := driver.LoadSource(sourceCode)
+	if err != nil {
+		t.Fatalf("error starting VM: %s", err)
+	}
+	driver.RunWithBreakpoints([]breakpoint{{line: 2}})
+
+	returnValue := func() string {
+		frames := driver.CollectFrames()
+		vars := frames[len(frames)-1].Vars
+		if len(vars) == 0 || vars[0].Name != ReturnValueName {
+			return ""
+		}
+		return vars[0].Value
+	}
+	steps := []struct {
+		step     func() (error, bool)
+		line     int
+		expected string
+	}{
+		// Out of square(2), back on the line that called it.
+		{driver.StepOut, 6, "4"},
+		{driver.StepOver, 7, ""},
+		{driver.StepInto, 2, ""},
+		{driver.StepOver, 3, ""},
+		// Over the end of square(3).
+		{driver.StepOver, 7, "9"},
+		{driver.StepOver, 8, ""},
+		// Out of run into main.
+		{driver.StepOut, 10, "13"},
+	}
+	for i, s := range steps {
+		s.step()
+		if line := driver.location().Line; line != s.line {
+			t.Fatalf("step %d: expected to stop on line %d, got=%d", i, s.line, line)
+		}
+		if actual := returnValue(); actual != s.expected {
+			t.Errorf("step %d: expected return value %q, got=%q", i, s.expected, actual)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	count := `let count = fn(n) {
+	if (n == 0) { return 0; }
+	count(n - 1) + 1
+};
+let run = fn(n) { count(n) };
+run(ARG);
+`
+	sum := `let sum = fn(n, step, total) {
+	let next = n - step;
+	let partial = total + n;
+	if (next < 0) { return partial; }
+	sum(next, step, partial)
+};
+sum(ARG, 1, 0);
+`
+	tests := []struct {
+		sourceCode      string
+		arg             string
+		maxCallDepth    int
+		maxInstructions int
+		expected        string
+	}{
+		{count, "10", 0, 0, ""},
+		{count, "20", 10, 0, `maximum recursion depth exceeded in count (depth 11)
+    count (line 2)
+    count (line 3) ×9
+    run (line 5)
+    main (line 6)`},
+		// The VM has no room for the default depth, the limit is lowered.
+		{count, "2000", 5000, 0, "maximum recursion depth exceeded in count (depth 1023)"},
+		{count, "10", 0, 30, `instruction budget of 30 exceeded in count
+    count (line 3) ×2
+    run (line 5)
+    main (line 6)`},
+		// Arguments and locals fill the stack below the default depth.
+		{sum, "100", 0, 0, ""},
+		{sum, "900", 0, 0, `stack overflow in sum (depth 341)
+    sum (line 5) ×341
+    main (line 7)`},
+	}
+	for _, tt := range tests {
+		driver := New()
+		driver.MaxCallDepth = tt.maxCallDepth
+		driver.MaxInstructions = tt.maxInstructions
+		err := driver.LoadSource(strings.Replace(tt.sourceCode, "ARG", tt.arg, 1))
+		if err != nil {
+			t.Fatalf("error starting VM: %s", err)
+		}
+		err, _ = driver.RunWithBreakpoints(nil)
+		if tt.expected == "" {
+			if err != nil || driver.State() != EXITED {
+				t.Errorf("expected the program to exit, got state=%s err=%v", driver.State(), err)
+			}
+			continue
+		}
+		if _, ok := err.(LimitError); !ok || driver.State() != RUNTIME_ERROR {
+			t.Fatalf("expected a LimitError, got state=%s err=%#v", driver.State(), err)
+		}
+		if !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("wrong error.\nexpected=%s\ngot=%s", tt.expected, err)
+		}
+	}
+}
+
+func TestPostMortem(t *testing.T) {
+	tests := []struct {
+		sourceCode string
+		line       int
+		// operands are the variables the failed frame starts with.
+		operands []string
+	}{
+		{
+			sourceCode: `let x = 5;
+let f = fn(a) {
+	let b = a * 2;
+	x(b)
+};
+f(1);
+`,
+			line:     4,
+			operands: []string{"(operand) x = 5", "(operand) b = 2"},
+		},
+		{
+			sourceCode: `let add = fn(a, b) {
+	let c = a;
+	c + b;
+	c
+};
+add(1, "one");
+`,
+			line:     3,
+			operands: []string{"(operand) c = 1", `(operand) b = "one"`},
+		},
+		{
+			sourceCode: `let h = {1: 2};
+let k = [1];
+let get = fn(n) { h[k] + n };
+get(1);
+`,
+			line:     3,
+			operands: []string{"(operand) h = {1: 2}", "(operand) k = [1]"},
+		},
+		{
+			// Operands that call functions are not evaluated again.
+			sourceCode: `let one = fn() { 1 };
+let s = "s";
+let r = one() + s;
+`,
+			line:     3,
+			operands: []string{"(operand) s = \"s\""},
+		},
+	}
+
+	for _, tt := range tests {
+		driver := New()
+		err := driver.LoadSource(tt.sourceCode)
+		if err != nil {
+			t.Fatalf("error starting VM: %s", err)
+		}
+		driver.RunWithBreakpoints(nil)
+		if driver.State() != RUNTIME_ERROR {
+			t.Fatalf("expected state=%s, got=%s", RUNTIME_ERROR, driver.State())
+		}
+		if line := driver.location().Line; line != tt.line {
+			t.Errorf("expected to fail on line %d, got=%d", tt.line, line)
+		}
+		frames := driver.CollectFrames()
+		top := frames[len(frames)-1]
+		if top.Line != tt.line {
+			t.Errorf("expected the failed frame on line %d, got=%d", tt.line, top.Line)
+		}
+		var operands []string
+		for _, v := range top.Vars {
+			if strings.HasPrefix(v.Name, OperandPrefix) {
+				operands = append(operands, fmt.Sprintf("%s = %s", v.Name, v.Value))
+			}
+		}
+		if !reflect.DeepEqual(operands, tt.operands) {
+			t.Errorf("expected operands %q, got=%q", tt.operands, operands)
+		}
+
+		err, _ = driver.StepOver()
+		if !errors.Is(err, ErrProgramFailed) {
+			t.Errorf("expected step to fail with %q, got=%v", ErrProgramFailed, err)
+		}
+		if driver.State() != RUNTIME_ERROR {
+			t.Errorf("expected state=%s after step, got=%s", RUNTIME_ERROR, driver.State())
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moritz-tiesler/monkey/code"
+	"github.com/moritz-tiesler/monkey/compiler"
+	"github.com/moritz-tiesler/monkey/exception"
+	"github.com/moritz-tiesler/monkey/lexer"
+	"github.com/moritz-tiesler/monkey/object"
+	"github.com/moritz-tiesler/monkey/parser"
+	"github.com/moritz-tiesler/monkey/vm"
+)
+
+// binding is a name that has been assigned a value in a frame.
+type binding struct {
+	name   string
+	index  int
+	global bool
+	value  object.Object
+}
+
+// frameBindings returns the parameters and the variables that have been
+// set in vmFrame so far. Names are resolved by position, not by object.
+func (d *Driver) frameBindings(vmFrame *vm.Frame) []binding {
+	objects, _ := d.VM.ActiveObjects(*vmFrame)
+	fn := vmFrame.Closure().Fn
+
+	bindings := make([]binding, 0, len(objects))
+	for i := 0; i < fn.NumParameters; i++ {
+		bindings = append(bindings, binding{
+			name:  d.VM.GetLocalName(fn, i),
+			index: i,
+		})
+	}
+
+	ins := fn.Instructions
+	for i := 0; i < vmFrame.Ip; {
+		op := code.Opcode(ins[i])
+		switch op {
+		case code.OpSetGlobal:
+			index := int(code.ReadUint16(ins[i+1:]))
+			bindings = append(bindings, binding{
+				name:   d.VM.GetGlobalName(index),
+				index:  index,
+				global: true,
+			})
+		case code.OpSetLocal:
+			index := int(code.ReadUint8(ins[i+1:]))
+			bindings = append(bindings, binding{
+				name:  d.VM.GetLocalName(fn, index),
+				index: index,
+			})
+		}
+		i += op.InstructionLength()
+	}
+
+	for i := range bindings {
+		bindings[i].value = objects[i]
+	}
+	return bindings
+}
+
+// numGlobals returns the number of global slots used by the program.
+func numGlobals(mainFn *object.CompiledFunction) int {
+	n := 0
+	ins := mainFn.Instructions
+	for i := 0; i < len(ins); {
+		op := code.Opcode(ins[i])
+		if op == code.OpSetGlobal {
+			index := int(code.ReadUint16(ins[i+1:]))
+			if index >= n {
+				n = index + 1
+			}
+		}
+		i += op.InstructionLength()
+	}
+	return n
+}
+
+// Evaluate runs expression on its own VM against the variables visible in
+// the frame with the given id.
+func (d *Driver) Evaluate(expression string, frameId int) (result object.Object, err error) {
+	if d.VM == nil {
+		return nil, errors.New("program is not running")
+	}
+	if frameId < 0 || frameId >= d.VM.FramesIndex() {
+		return nil, fmt.Errorf("invalid frame id=%d", frameId)
+	}
+
+	parser := parser.New(lexer.New(expression))
+	program := parser.ParseProgram()
+	if parserErrors := parser.Errors(); len(parserErrors) > 0 {
+		return nil, parserErrors[0]
+	}
+
+	symbols := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbols.DefineBuiltin(i, v.Name)
+	}
+	globals := make([]object.Object, vm.GlobalsSize)
+
+	// Globals keep their slots, so that closures of the program which
+	// read globals keep working when they are called by the expression.
+	// Slots that have not been set yet are hidden behind a name that
+	// cannot be referenced.
+	vmFrames := d.VM.Frames()
+	mainFrame := vmFrames[0]
+	isSet := make(map[int]object.Object)
+	for _, b := range d.frameBindings(mainFrame) {
+		isSet[b.index] = b.value
+	}
+	for i := 0; i < numGlobals(mainFrame.Closure().Fn); i++ {
+		value, ok := isSet[i]
+		if !ok {
+			symbols.Define("")
+			continue
+		}
+		symbols.Define(d.VM.GetGlobalName(i))
+		globals[i] = value
+	}
+
+	// Locals of the selected frame shadow globals of the same name.
+	if frameId > 0 {
+		vmFrame := vmFrames[frameId]
+		cl := vmFrame.Closure()
+		if name := cl.Fn.Name; name != "" {
+			if _, ok := symbols.Resolve(name); !ok {
+				globals[symbols.Define(name).Index] = cl
+			}
+		}
+		for _, b := range d.frameBindings(vmFrame) {
+			globals[symbols.Define(b.name).Index] = b.value
+		}
+	}
+
+	// The expression's constants are appended to the program's, so that
+	// constant indices in closures of the program stay valid.
+	constants := make([]object.Object, len(d.constants))
+	copy(constants, d.constants)
+	compiler := compiler.NewWithState(symbols, constants)
+	compileErr := compiler.Compile(program)
+	if compileErr != nil {
+		return nil, compileErr
+	}
+
+	machine := vm.NewWithGlobalStore(compiler.Bytecode(), globals)
+	machine.NameStore = compiler.NameStore
+	machine.LocationMap = d.evaluationLocations(machine, compiler)
+
+	defer func() {
+		if r := recover(); r != nil {
+			result = nil
+			err = fmt.Errorf("could not evaluate %q: %v", expression, r)
+		}
+	}()
+
+	// The expression runs without the hooks of the program, only Cancel
+	// stops it.
+	cancelled := false
+	condition := func(vm *vm.VM) (bool, exception.Exception) {
+		cancelled = atomic.CompareAndSwapInt32(&d.cancelled, 1, 0)
+		return cancelled, nil
+	}
+	_, runErr, _ := machine.RunWithCondition(condition)
+	if cancelled {
+		return nil, ErrCancelled
+	}
+	if runErr != nil {
+		return nil, runErr
+	}
+
+	result = machine.LastPoppedStackElem()
+	if result == nil {
+		return nil, fmt.Errorf("%q has no value", expression)
+	}
+	return result, nil
+}
+
+// evaluationLocations merges the locations of the program with those of
+// the compiled expression. The VM for the expression creates its own main
+// function, so locations in the main scope are moved over to it.
+func (d *Driver) evaluationLocations(machine *vm.VM, c *compiler.Compiler) compiler.LocationMap {
+	locations := make(compiler.LocationMap, len(d.VM.LocationMap)+len(c.LocationMap))
+	for k, v := range d.VM.LocationMap {
+		locations[k] = v
+	}
+
+	compiledMain := c.MainFn()
+	machineMain := machine.CurrentFrame().Closure().Fn
+	for k, v := range c.LocationMap {
+		if k.ScopeId == compiledMain {
+			k.ScopeId = machineMain
+		}
+		locations[k] = v
+	}
+	return locations
+}
@@ -0,0 +1,129 @@
+package driver
+
+import (
+	"github.com/moritz-tiesler/monkey/object"
+)
+
+// Event is a transition of the program that the driver reports to its
+// observers. The events are Started, StoppedOnBreakpoint, StepCompleted,
+// Paused, Exited, Errored and BreakpointChanged.
+type Event interface {
+	event()
+}
+
+// Started is emitted when a VM was started for a program.
+type Started struct{}
+
+// StoppedOnBreakpoint is emitted when a run stops on a line, function or
+// data breakpoint. Ids are the ids of the breakpoints that were hit.
+type StoppedOnBreakpoint struct {
+	Location Location
+	Function string
+	// Binding is the binding of a data breakpoint that Value was written to.
+	Binding string
+	Value   object.Object
+	Ids     []int
+}
+
+// StepCompleted is emitted when a step stops on the next line.
+type StepCompleted struct {
+	Location Location
+}
+
+// Paused is emitted when the program was paused on entry, by Cancel or
+// after Goto.
+type Paused struct {
+	Reason   PauseReason
+	Location Location
+}
+
+// Exited is emitted when the program ran to completion. Value is the
+// value of the last expression statement, nil if there was none.
+type Exited struct {
+	Value object.Object
+	Code  int
+}
+
+// Errored is emitted when the program could not be loaded or compiled,
+// or failed at runtime. Location is where the error occurred.
+type Errored struct {
+	Err      error
+	Location Location
+}
+
+// BreakpointChanged is emitted when loading a program moved a breakpoint
+// to another line or changed whether it is verified.
+type BreakpointChanged struct {
+	Breakpoint Breakpoint
+}
+
+func (Started) event()             {}
+func (StoppedOnBreakpoint) event() {}
+func (StepCompleted) event()       {}
+func (Paused) event()              {}
+func (Exited) event()              {}
+func (Errored) event()             {}
+func (BreakpointChanged) event()   {}
+
+// Subscribe registers observe to be called with every event of the driver.
+// observe is called on the goroutine that runs the driver, before the
+// method that caused the event returns.
+func (d *Driver) Subscribe(observe func(e Event)) {
+	d.observers = append(d.observers, observe)
+}
+
+func (d *Driver) emit(e Event) {
+	d.logf("event %T%+v", e, e)
+	for _, observe := range d.observers {
+		observe(e)
+	}
+}
+
+// report moves the program out of RUNNING at the end of a run and emits
+// the event for the new state. A run that stopped before the end of the
+// program is paused for reason.
+func (d *Driver) report(err error, conditionMet bool, reason PauseReason) {
+	switch {
+	case err == ErrCancelled:
+		d.pause(PausedByCancel)
+		d.emit(Paused{Reason: PausedByCancel, Location: d.location()})
+	case err != nil:
+		d.setState(RUNTIME_ERROR)
+		d.emit(Errored{Err: err, Location: d.location()})
+	case reason == PausedOnBreakpoint && conditionMet && d.hitBinding != "":
+		d.pause(PausedOnDataBreakpoint)
+		d.emit(StoppedOnBreakpoint{Location: d.location(), Binding: d.hitBinding, Value: d.hitValue, Ids: d.hitBreakpoints})
+	case d.atEnd():
+		d.result = d.VM.LastPoppedStackElem()
+		d.setState(EXITED)
+		d.emit(Exited{Value: d.result, Code: d.ExitCode()})
+	case reason == PausedOnBreakpoint && conditionMet && d.hitFunction != "":
+		d.pause(PausedOnFunctionBreakpoint)
+		d.emit(StoppedOnBreakpoint{Location: d.location(), Function: d.hitFunction, Ids: d.hitBreakpoints})
+	case reason == PausedOnBreakpoint && conditionMet:
+		d.pause(reason)
+		d.emit(StoppedOnBreakpoint{Location: d.location(), Ids: d.hitBreakpoints})
+	default:
+		d.pause(reason)
+		d.emit(StepCompleted{Location: d.location()})
+	}
+}
+
+func (d *Driver) pause(reason PauseReason) {
+	d.pauseReason = reason
+	d.setState(PAUSED)
+}
+
+// location returns the location of the next instruction of the VM, the
+// instruction that failed if the program failed.
+func (d *Driver) location() Location {
+	if d.failedFrame != nil {
+		return d.FileLocation(d.failedAt.Range.Start.Line)
+	}
+	if d.atEnd() {
+		// A data breakpoint on the last instruction stops at its end.
+		f := d.VM.CurrentFrame()
+		return d.FileLocation(sourceLocation(d.VM, f, f.Ip).Range.Start.Line)
+	}
+	return d.FileLocation(currentLocation(d.VM).Range.Start.Line)
+}
@@ -0,0 +1,182 @@
+package driver
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/moritz-tiesler/monkey/object"
+)
+
+// DefaultMaxValueLength is the number of characters after which values
+// are cut off, unless a ValueFormat sets another limit.
+const DefaultMaxValueLength = 1000
+
+// ValueFormat controls how FormatValue shows a value.
+type ValueFormat struct {
+	// Hex shows integers in hexadecimal.
+	Hex bool
+	// MaxLength is the number of characters after which the value is cut
+	// off with an ellipsis. 0 means DefaultMaxValueLength.
+	MaxLength int
+}
+
+// FormatValue returns obj the way it is written in Monkey, with hash pairs
+// sorted by key. Long values are cut off.
+func FormatValue(obj object.Object, format ValueFormat) string {
+	limit := format.MaxLength
+	if limit <= 0 {
+		limit = DefaultMaxValueLength
+	}
+	f := &formatter{format: format, limit: limit}
+	f.value(obj)
+	return f.String()
+}
+
+type formatter struct {
+	out strings.Builder
+	// n is the number of characters written to out.
+	n      int
+	format ValueFormat
+	limit  int
+}
+
+func (f *formatter) write(s string) {
+	f.out.WriteString(s)
+	f.n += utf8.RuneCountInString(s)
+}
+
+// full reports whether more than limit characters have been written.
+// Formatting stops there, String cuts the output to limit characters.
+func (f *formatter) full() bool {
+	return f.n > f.limit
+}
+
+func (f *formatter) value(obj object.Object) {
+	if f.full() {
+		return
+	}
+	switch obj := obj.(type) {
+	case nil:
+		f.write("null")
+	case *object.Integer:
+		if f.format.Hex {
+			f.write(fmt.Sprintf("%#x", obj.Value))
+		} else {
+			f.write(strconv.FormatInt(obj.Value, 10))
+		}
+	case *object.String:
+		// Only the part of a long string that can be shown is quoted.
+		value := obj.Value
+		n := 0
+		for i := range value {
+			if n > f.limit {
+				value = value[:i]
+				break
+			}
+			n++
+		}
+		f.write(strconv.Quote(value))
+	case *object.Closure:
+		f.write("function")
+	case *object.Array:
+		f.write("[")
+		for i, e := range obj.Elements {
+			if f.full() {
+				return
+			}
+			if i > 0 {
+				f.write(", ")
+			}
+			f.value(e)
+		}
+		f.write("]")
+	case *object.Hash:
+		f.write("{")
+		for i, p := range f.shownPairs(obj) {
+			if f.full() {
+				return
+			}
+			if i > 0 {
+				f.write(", ")
+			}
+			f.write(p.key)
+			f.write(": ")
+			f.value(p.Value)
+		}
+		f.write("}")
+	default:
+		f.write(obj.Inspect())
+	}
+}
+
+// minPairLength is the least number of characters a hash pair takes, as
+// in `1: 1, `.
+const minPairLength = 6
+
+type formattedPair struct {
+	object.HashPair
+	key string
+}
+
+// pairBefore orders hash pairs by their formatted keys, integer keys by
+// their value.
+func pairBefore(a, b formattedPair) bool {
+	x, xIsInt := a.Key.(*object.Integer)
+	y, yIsInt := b.Key.(*object.Integer)
+	if xIsInt && yIsInt {
+		return x.Value < y.Value
+	}
+	return a.key < b.key
+}
+
+// pairHeap has the pair that is shown last on top.
+type pairHeap []formattedPair
+
+func (h pairHeap) Len() int           { return len(h) }
+func (h pairHeap) Less(i, j int) bool { return pairBefore(h[j], h[i]) }
+func (h pairHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *pairHeap) Push(x any)        { *h = append(*h, x.(formattedPair)) }
+func (h *pairHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// shownPairs returns the first pairs of hash in order, but no more than
+// fit into the characters that are left. Huge hashes are not sorted in
+// full.
+func (f *formatter) shownPairs(hash *object.Hash) []formattedPair {
+	n := min((f.limit-f.n)/minPairLength+1, len(hash.Pairs))
+	h := make(pairHeap, 0, n)
+	for _, p := range hash.Pairs {
+		pair := formattedPair{HashPair: p, key: FormatValue(p.Key, f.format)}
+		if len(h) < n {
+			heap.Push(&h, pair)
+		} else if pairBefore(pair, h[0]) {
+			h[0] = pair
+			heap.Fix(&h, 0)
+		}
+	}
+	sort.Slice(h, func(i, j int) bool { return pairBefore(h[i], h[j]) })
+	return h
+}
+
+func (f *formatter) String() string {
+	s := f.out.String()
+	if f.n <= f.limit {
+		return s
+	}
+	n := 0
+	for i := range s {
+		if n == f.limit {
+			return s[:i] + "…"
+		}
+		n++
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// importPattern matches a line like import("lib/option.mky"); with a path
+// relative to the importing file.
+var importPattern = regexp.MustCompile(`^\s*import\(\s*"([^"]+)"\s*\)\s*;?\s*$`)
+
+// SourceFile is one of the files a program is made of. The file of a
+// program that is not saved to disk has an empty Path.
+type SourceFile struct {
+	Path string
+	Code string
+}
+
+// Location is a line in one of the files of a program.
+type Location struct {
+	Source string
+	Line   int
+}
+
+// ImportError is reported when an imported file cannot be read.
+type ImportError struct {
+	message string
+	line    int
+	col     int
+}
+
+func (ie ImportError) Error() string {
+	return fmt.Sprintf("Import error: %s: Line: %d, Col: %d", ie.message, ie.line, ie.col)
+}
+
+func (ie ImportError) Line() int {
+	return ie.line
+}
+
+func (ie ImportError) Col() int {
+	return ie.col
+}
+
+// linker splices the lines of imported files into a single program, each
+// file at its first import. Import lines are kept as empty lines.
+type linker struct {
+	files   []SourceFile
+	lines   []string
+	origins []Location
+	seen    map[string]bool
+}
+
+func link(path string, code string) (*linker, error) {
+	l := &linker{seen: make(map[string]bool)}
+	if path != "" {
+		l.seen[path] = true
+	}
+	err := l.include(path, code)
+	return l, err
+}
+
+func (l *linker) include(path string, code string) error {
+	l.files = append(l.files, SourceFile{Path: path, Code: code})
+
+	for i, line := range strings.Split(code, "\n") {
+		match := importPattern.FindStringSubmatch(line)
+		if match == nil {
+			l.emit(line, path, i+1)
+			continue
+		}
+		l.emit("", path, i+1)
+
+		imported := match[1]
+		if !filepath.IsAbs(imported) {
+			imported = filepath.Join(filepath.Dir(path), imported)
+		}
+		imported = filepath.Clean(imported)
+		if l.seen[imported] {
+			continue
+		}
+		l.seen[imported] = true
+
+		importedCode, err := os.ReadFile(imported)
+		if err != nil {
+			col := strings.Index(line, match[1]) + 1
+			return ImportError{
+				message: fmt.Sprintf("could not import %q", match[1]),
+				line:    len(l.lines),
+				col:     col,
+			}
+		}
+		err = l.include(imported, string(importedCode))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *linker) emit(line string, path string, fileLine int) {
+	l.lines = append(l.lines, line)
+	l.origins = append(l.origins, Location{Source: path, Line: fileLine})
+}
+
+// FileLocation maps a line of the linked program to the file it came from.
+func (d *Driver) FileLocation(line int) Location {
+	if line < 1 || line > len(d.origins) {
+		return Location{Source: d.Source, Line: line}
+	}
+	return d.origins[line-1]
+}
@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moritz-tiesler/monkey/exception"
+	"github.com/moritz-tiesler/monkey/vm"
+)
+
+// DefaultMaxCallDepth is the number of calls that may be in progress at
+// the same time, unless Driver.MaxCallDepth sets another limit.
+const DefaultMaxCallDepth = 1000
+
+// maxCallDepth is the deepest call the VM has room for, it panics beyond.
+const maxCallDepth = vm.MaxFrames - 2
+
+// LimitError is the error of a program that exceeded the call depth or
+// the instruction budget of the driver.
+type LimitError struct {
+	Message string
+	line    int
+	col     int
+}
+
+func (e LimitError) Error() string { return e.Message }
+func (e LimitError) Line() int     { return e.line }
+func (e LimitError) Col() int      { return e.col }
+
+// callDepthLimit returns the maximum call depth of the driver.
+func (d *Driver) callDepthLimit() int {
+	limit := d.MaxCallDepth
+	if limit <= 0 {
+		limit = DefaultMaxCallDepth
+	}
+	return min(limit, maxCallDepth)
+}
+
+// checkLimits returns an error if machine entered a call deeper than the
+// call depth limit, or is about to execute an instruction beyond the
+// instruction budget.
+func (d *Driver) checkLimits(machine *vm.VM) exception.Exception {
+	depth := machine.FramesIndex() - 1
+	if limit := d.callDepthLimit(); depth > limit {
+		return d.limitError(machine, "maximum recursion depth exceeded in %s (depth %d)", functionName(machine, depth), depth)
+	}
+	if d.MaxInstructions > 0 && d.instructions >= d.MaxInstructions {
+		return d.limitError(machine, "instruction budget of %d exceeded in %s", d.MaxInstructions, functionName(machine, depth))
+	}
+	return nil
+}
+
+// stackOverflow starts the error of a VM that has no room left on its
+// stack. Calls with many arguments and locals fill the stack before the
+// call depth limit is reached.
+const stackOverflow = "Runtime error. stack overflow:"
+
+// overflowError returns a LimitError with the call stack in place of a
+// stack overflow err of the VM.
+func (d *Driver) overflowError(machine *vm.VM, err exception.Exception) exception.Exception {
+	f := machine.CurrentFrame()
+	if !strings.HasPrefix(err.Error(), stackOverflow) || f != d.cycleFrame {
+		return err
+	}
+	f.Ip = d.cycleIp
+	depth := machine.FramesIndex() - 1
+	limitErr := d.limitError(machine, "stack overflow in %s (depth %d)", functionName(machine, depth), depth)
+	f.Ip--
+	return limitErr
+}
+
+// limitError returns a LimitError located at the next instruction of
+// machine.
+func (d *Driver) limitError(machine *vm.VM, format string, args ...any) LimitError {
+	loc := currentLocation(machine)
+	return LimitError{
+		Message: fmt.Sprintf(format, args...) + "\n" + d.collapsedStack(machine),
+		line:    loc.Range.Start.Line,
+		col:     loc.Range.Start.Col,
+	}
+}
+
+// collapsedStack returns the call stack of machine, the innermost call
+// first. Consecutive calls of the same function from the same line are
+// shown once, with their number.
+func (d *Driver) collapsedStack(machine *vm.VM) string {
+	frames := machine.Frames()[:machine.FramesIndex()]
+	// The line the frame at depth executes.
+	lineAt := func(depth int) int {
+		loc := callSite(machine, frames[depth])
+		if depth == len(frames)-1 {
+			loc = currentLocation(machine)
+		}
+		return d.FileLocation(loc.Range.Start.Line).Line
+	}
+
+	var lines []string
+	for depth := len(frames) - 1; depth >= 0; {
+		name, line := functionName(machine, depth), lineAt(depth)
+		n := 1
+		for depth-n > 0 && functionName(machine, depth-n) == name && lineAt(depth-n) == line {
+			n++
+		}
+		if n > 1 {
+			lines = append(lines, fmt.Sprintf("    %s (line %d) ×%d", name, line, n))
+		} else {
+			lines = append(lines, fmt.Sprintf("    %s (line %d)", name, line))
+		}
+		depth -= n
+	}
+	return strings.Join(lines, "\n")
+}
+
+// functionName returns the name of the function of the frame at depth.
+func functionName(machine *vm.VM, depth int) string {
+	if depth == 0 {
+		return "main"
+	}
+	if name := machine.Frames()[depth].Name(); name != "" {
+		return name
+	}
+	return "anonymous"
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moritz-tiesler/monkey/code"
+	"github.com/moritz-tiesler/monkey/object"
+)
+
+// builtinParameters names the parameters of the builtin functions. The
+// builtins are implemented in Go, so their signatures are not available
+// at runtime.
+var builtinParameters = map[string]string{
+	"len":   "arg",
+	"puts":  "...args",
+	"first": "arr",
+	"last":  "arr",
+	"rest":  "arr",
+	"push":  "arr, elem",
+}
+
+// BuiltinsListing returns Monkey-style declarations of the builtin
+// functions that are available to every program.
+func BuiltinsListing() string {
+	var out strings.Builder
+	out.WriteString("// Builtin functions of the Monkey VM.\n")
+	out.WriteString("// They are implemented natively and cannot be stepped into.\n\n")
+	for _, b := range object.Builtins {
+		params, ok := builtinParameters[b.Name]
+		if !ok {
+			params = "..."
+		}
+		fmt.Fprintf(&out, "let %s = fn(%s) { <builtin> };\n", b.Name, params)
+	}
+	return out.String()
+}
+
+// FunctionIndex returns the index of fn among the constants of the
+// program, or -1 if fn is not one of them.
+func (d *Driver) FunctionIndex(fn *object.CompiledFunction) int {
+	for i, c := range d.constants {
+		if c == fn {
+			return i
+		}
+	}
+	return -1
+}
+
+// Listing decompiles fn into one line per instruction. Instructions that
+// map to a source location are annotated with their line.
+func (d *Driver) Listing(fn *object.CompiledFunction) string {
+	lines := make(map[int]int)
+	for k, v := range d.VM.LocationMap {
+		if k.ScopeId == fn {
+			lines[k.InstructionIndex] = v.Range.Start.Line
+		}
+	}
+
+	var out strings.Builder
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	fmt.Fprintf(&out, "// %s: %d parameters, %d locals\n", name, fn.NumParameters, fn.NumLocals)
+
+	ins := fn.Instructions
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			i++
+			continue
+		}
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		instruction := def.Name
+		for _, o := range operands {
+			instruction = fmt.Sprintf("%s %d", instruction, o)
+		}
+		if line, ok := lines[i]; ok {
+			fmt.Fprintf(&out, "%04d %-20s // line %d\n", i, instruction, line)
+		} else {
+			fmt.Fprintf(&out, "%04d %s\n", i, instruction)
+		}
+		i += 1 + read
+	}
+	return out.String()
+}
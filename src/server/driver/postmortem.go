@@ -0,0 +1,221 @@
+package driver
+
+import (
+	"github.com/moritz-tiesler/monkey/ast"
+	"github.com/moritz-tiesler/monkey/code"
+	"github.com/moritz-tiesler/monkey/compiler"
+)
+
+// OperandPrefix starts the names of the variables that hold the operands
+// of the instruction a program failed on, e.g. "(operand) x".
+const OperandPrefix = "(operand) "
+
+// operators are the infix operators each binary instruction implements.
+var operators = map[code.Opcode][]string{
+	code.OpAdd:         {"+"},
+	code.OpSub:         {"-"},
+	code.OpMul:         {"*"},
+	code.OpDiv:         {"/"},
+	code.OpEqual:       {"=="},
+	code.OpNotEqual:    {"!="},
+	code.OpGreaterThan: {">", "<"},
+}
+
+// keepFailure keeps the state of a program that failed for inspection,
+// with the VM before the instruction that failed.
+func (d *Driver) keepFailure() {
+	f := d.VM.CurrentFrame()
+	f.Ip = d.cycleIp - 1
+	node, loc := d.failedNode()
+	if node != nil {
+		loc.Range = node.Range()
+	}
+	d.failedFrame = f
+	d.failedAt = loc
+	d.operands = d.evaluateOperands(node)
+}
+
+// evaluateOperands evaluates the operands of node, the expression the
+// program failed on, except calls and literals.
+func (d *Driver) evaluateOperands(node ast.Node) []DriverVar {
+	var operands []ast.Expression
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		operands = append([]ast.Expression{node.Function}, node.Arguments...)
+	case *ast.IndexExpression:
+		operands = []ast.Expression{node.Left, node.Index}
+	case *ast.InfixExpression:
+		operands = []ast.Expression{node.Left, node.Right}
+	}
+
+	frameId := d.VM.FramesIndex() - 1
+	seen := map[string]bool{}
+	var vars []DriverVar
+	for _, operand := range operands {
+		switch operand.(type) {
+		case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean, *ast.FunctionLiteral:
+			continue
+		}
+		expression := operand.String()
+		if seen[expression] || hasCall(operand) {
+			continue
+		}
+		seen[expression] = true
+		value, err := d.Evaluate(expression, frameId)
+		if err != nil {
+			d.logf("could not evaluate operand %q: %s", expression, err)
+			continue
+		}
+		vars = append(vars, ObjectToDriverVar(value, OperandPrefix+expression))
+	}
+	return vars
+}
+
+// failedNode returns the call, index or infix expression of the
+// instruction the program failed on, nil if it is none of them, and the
+// location of the last instruction up to it that has one.
+func (d *Driver) failedNode() (ast.Node, compiler.LocationData) {
+	f := d.VM.CurrentFrame()
+	ins := f.Instructions()
+	ip := f.Ip + 1
+	if ip < 0 || ip >= len(ins) {
+		return nil, compiler.LocationData{}
+	}
+	// Calls and index expressions are located at the instruction, binary
+	// instructions at their last operand: either way the location lies in
+	// the expression.
+	var loc compiler.LocationData
+	found := false
+	fn := f.Closure().Fn
+	for i := ip; i >= 0 && !found; i-- {
+		loc, found = d.VM.LocationMap[compiler.LocationKey{ScopeId: fn, InstructionIndex: i}]
+	}
+	if !found {
+		return nil, sourceLocation(d.VM, f, ip)
+	}
+	if d.program == nil {
+		return nil, loc
+	}
+
+	var matches func(node ast.Node) bool
+	switch op := code.Opcode(ins[ip]); op {
+	case code.OpCall:
+		matches = func(node ast.Node) bool {
+			_, ok := node.(*ast.CallExpression)
+			return ok
+		}
+	case code.OpIndex:
+		matches = func(node ast.Node) bool {
+			_, ok := node.(*ast.IndexExpression)
+			return ok
+		}
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		matches = func(node ast.Node) bool {
+			infix, ok := node.(*ast.InfixExpression)
+			if !ok {
+				return false
+			}
+			for _, operator := range operators[op] {
+				if infix.Operator == operator {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return nil, loc
+	}
+
+	// The innermost expression around the location is the one that
+	// failed, unless one starts and ends exactly there.
+	var failed ast.Node
+	inspect(d.program, func(node ast.Node) bool {
+		if failed != nil && failed.Range() == loc.Range {
+			return false
+		}
+		if matches(node) && contains(node.Range(), loc.Range.Start) {
+			failed = node
+		}
+		return true
+	})
+	return failed, loc
+}
+
+// contains reports whether pos lies within r.
+func contains(r ast.NodeRange, pos ast.Position) bool {
+	after := pos.Line > r.Start.Line || pos.Line == r.Start.Line && pos.Col >= r.Start.Col
+	before := pos.Line < r.End.Line || pos.Line == r.End.Line && pos.Col <= r.End.Col
+	return after && before
+}
+
+// hasCall reports whether evaluating expression calls a function.
+func hasCall(expression ast.Expression) bool {
+	call := false
+	inspect(expression, func(node ast.Node) bool {
+		if _, ok := node.(*ast.CallExpression); ok {
+			call = true
+		}
+		return !call
+	})
+	return call
+}
+
+// inspect calls visit for node and the nodes in it, outer nodes before
+// inner ones, until visit returns false.
+func inspect(node ast.Node, visit func(node ast.Node) bool) bool {
+	if !visit(node) {
+		return false
+	}
+	var children []ast.Node
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			children = append(children, s)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			children = append(children, s)
+		}
+	case *ast.LetStatement:
+		children = append(children, node.Value)
+	case *ast.ReturnStatement:
+		children = append(children, node.ReturnValue)
+	case *ast.ExpressionStatement:
+		children = append(children, node.Expression)
+	case *ast.PrefixExpression:
+		children = append(children, node.Right)
+	case *ast.InfixExpression:
+		children = append(children, node.Left, node.Right)
+	case *ast.IfExpression:
+		children = append(children, node.Condition, node.Consequence)
+		if node.Alternative != nil {
+			children = append(children, node.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		children = append(children, node.Body)
+	case *ast.CallExpression:
+		children = append(children, node.Function)
+		for _, arg := range node.Arguments {
+			children = append(children, arg)
+		}
+	case *ast.IndexExpression:
+		children = append(children, node.Left, node.Index)
+	case *ast.ArrayLiteral:
+		for _, e := range node.Elements {
+			children = append(children, e)
+		}
+	case *ast.HashLiteral:
+		for _, pair := range node.OrderedPairs {
+			children = append(children, pair.Key, pair.Value)
+		}
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if !inspect(child, visit) {
+			return false
+		}
+	}
+	return true
+}
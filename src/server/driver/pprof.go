@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// Write writes p in the gzipped pprof format, for go tool pprof.
+func (p *Profile) Write(w io.Writer) error {
+	strings := newStringTable()
+	var out protoBuffer
+
+	valueType := func(typ, unit string) []byte {
+		var b protoBuffer
+		b.int64(1, strings.index(typ))
+		b.int64(2, strings.index(unit))
+		return b.data
+	}
+	out.message(1, valueType("instructions", "count"))
+	out.message(1, valueType("time", "nanoseconds"))
+
+	for _, s := range p.samples {
+		var b protoBuffer
+		ids := make([]uint64, len(s.stack))
+		for i, id := range s.stack {
+			ids[i] = uint64(id)
+		}
+		b.packed(1, ids)
+		b.packed(2, []uint64{uint64(s.instructions), uint64(s.nanos)})
+		out.message(2, b.data)
+	}
+
+	for i, loc := range p.locations {
+		var line protoBuffer
+		line.int64(1, int64(loc.function))
+		line.int64(2, int64(loc.line.Line))
+		var b protoBuffer
+		b.int64(1, int64(i+1))
+		b.message(4, line.data)
+		out.message(4, b.data)
+	}
+
+	for i, fn := range p.functions {
+		var b protoBuffer
+		b.int64(1, int64(i+1))
+		b.int64(2, strings.index(fn.name))
+		b.int64(3, strings.index(fn.name))
+		b.int64(4, strings.index(fn.source))
+		b.int64(5, int64(fn.startLine))
+		out.message(5, b.data)
+	}
+
+	// The string table is complete once everything else was encoded.
+	for _, s := range strings.strings {
+		out.string(6, s)
+	}
+	out.int64(9, p.start.UnixNano())
+	out.int64(10, time.Since(p.start).Nanoseconds())
+	out.message(11, valueType("instructions", "count"))
+	out.int64(12, 1)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// stringTable numbers the strings of a profile. The first string must be
+// empty.
+type stringTable struct {
+	strings []string
+	indices map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{strings: []string{""}, indices: map[string]int64{"": 0}}
+}
+
+func (t *stringTable) index(s string) int64 {
+	if i, ok := t.indices[s]; ok {
+		return i
+	}
+	t.strings = append(t.strings, s)
+	t.indices[s] = int64(len(t.strings) - 1)
+	return t.indices[s]
+}
+
+// protoBuffer encodes the protocol buffer fields that profiles use.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// int64 encodes a field that is left out if it is 0, like proto3 does.
+func (b *protoBuffer) int64(field int, x int64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(uint64(x))
+}
+
+// string encodes an element of a repeated string field, which is encoded
+// even if it is empty.
+func (b *protoBuffer) string(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protoBuffer) message(field int, data []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.message(field, p.data)
+}
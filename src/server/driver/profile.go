@@ -0,0 +1,174 @@
+package driver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moritz-tiesler/monkey/object"
+	"github.com/moritz-tiesler/monkey/vm"
+)
+
+// Profile counts the instructions a program executes and the wall time
+// they take, per line and call stack. Set it as Driver.Profile to profile
+// the runs of the driver, Write exports it in the pprof format.
+type Profile struct {
+	start     time.Time
+	functions []profileFunction
+	locations []profileLocation
+	samples   []*profileSample
+	// functionIds, locationIds and sampleIds are 1 + the index of the
+	// function, location or sample with the given key. Samples are keyed
+	// by the locations of their callers, then by their innermost location.
+	functionIds map[*object.CompiledFunction]int
+	locationIds map[profileLine]int
+	sampleIds   map[string]map[int]int
+	// top is the innermost frame of the previous instruction, callers
+	// the locations of the frames below it and topSamples their samples.
+	// They only change with a call or a return.
+	top        *vm.Frame
+	callers    []int
+	topSamples map[int]int
+	// last is the sample of the previous instruction, that is charged
+	// the time until the next one starts at lastTime.
+	last     *profileSample
+	lastTime time.Time
+}
+
+type profileFunction struct {
+	name      string
+	source    string
+	startLine int
+}
+
+// profileLine is a line of a function.
+type profileLine struct {
+	fn   *object.CompiledFunction
+	line Location
+}
+
+type profileLocation struct {
+	function int
+	line     Location
+}
+
+// profileSample is a call stack, the innermost location first, and the
+// instructions and the time it took.
+type profileSample struct {
+	stack        []int
+	instructions int64
+	nanos        int64
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		start:       time.Now(),
+		functionIds: map[*object.CompiledFunction]int{},
+		locationIds: map[profileLine]int{},
+		sampleIds:   map[string]map[int]int{},
+	}
+}
+
+// Instructions returns the number of instructions executed on each line
+// of the program, including the instructions of the functions called
+// from there.
+func (p *Profile) Instructions() map[Location]int64 {
+	lines := map[Location]int64{}
+	for _, s := range p.samples {
+		seen := map[Location]bool{}
+		for _, id := range s.stack {
+			line := p.locations[id-1].line
+			// Recursive calls count once per line.
+			if !seen[line] {
+				seen[line] = true
+				lines[line] += s.instructions
+			}
+		}
+	}
+	return lines
+}
+
+// record counts the instruction machine is about to execute and charges
+// the time since the previous one to that.
+func (p *Profile) record(d *Driver, machine *vm.VM) {
+	now := time.Now()
+	if p.last != nil {
+		p.last.nanos += now.Sub(p.lastTime).Nanoseconds()
+	}
+
+	frames := machine.Frames()[:machine.FramesIndex()]
+	f := frames[len(frames)-1]
+	if f != p.top || len(frames) != len(p.callers)+1 {
+		p.enterFrame(d, machine, frames)
+	}
+	loc := sourceLocation(machine, f, f.Ip)
+	top := p.location(d, machine, f, d.FileLocation(loc.Range.Start.Line))
+
+	id, ok := p.topSamples[top]
+	if !ok {
+		stack := append([]int{top}, p.callers...)
+		p.samples = append(p.samples, &profileSample{stack: stack})
+		id = len(p.samples)
+		p.topSamples[top] = id
+	}
+	s := p.samples[id-1]
+	s.instructions++
+	p.last = s
+	p.lastTime = now
+}
+
+// enterFrame looks up the callers of the innermost of frames.
+func (p *Profile) enterFrame(d *Driver, machine *vm.VM, frames []*vm.Frame) {
+	p.top = frames[len(frames)-1]
+	p.callers = make([]int, len(frames)-1)
+	var key strings.Builder
+	for i := range p.callers {
+		f := frames[len(frames)-2-i]
+		loc := callSite(machine, f)
+		p.callers[i] = p.location(d, machine, f, d.FileLocation(loc.Range.Start.Line))
+		key.WriteString(strconv.Itoa(p.callers[i]))
+		key.WriteByte(',')
+	}
+	p.topSamples = p.sampleIds[key.String()]
+	if p.topSamples == nil {
+		p.topSamples = map[int]int{}
+		p.sampleIds[key.String()] = p.topSamples
+	}
+}
+
+// endRun charges the time until now to the last instruction of a run.
+// The time the program is paused is not profiled.
+func (p *Profile) endRun(now time.Time) {
+	if p.last != nil {
+		p.last.nanos += now.Sub(p.lastTime).Nanoseconds()
+	}
+	p.last = nil
+}
+
+// location returns the id of line of the function of frame f.
+func (p *Profile) location(d *Driver, machine *vm.VM, f *vm.Frame, line Location) int {
+	fn := f.Closure().Fn
+	key := profileLine{fn: fn, line: line}
+	if id, ok := p.locationIds[key]; ok {
+		return id
+	}
+
+	function, ok := p.functionIds[fn]
+	if !ok {
+		// pprof drops names in angle brackets like <anonymous>.
+		name := fn.Name
+		switch {
+		case f == machine.Frames()[0]:
+			name = "main"
+		case name == "":
+			name = "anonymous"
+		}
+		start := d.FileLocation(sourceLocation(machine, f, 0).Range.Start.Line)
+		p.functions = append(p.functions, profileFunction{name: name, source: start.Source, startLine: start.Line})
+		function = len(p.functions)
+		p.functionIds[fn] = function
+	}
+	p.locations = append(p.locations, profileLocation{function: function, line: line})
+	p.locationIds[key] = len(p.locations)
+	return len(p.locations)
+}
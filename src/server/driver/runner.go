@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"sync/atomic"
+)
+
+// Runner runs everything that touches a Driver on a single goroutine.
+// Queries are also answered between two instructions of a running command.
+type Runner struct {
+	driver   *Driver
+	commands chan func()
+	queries  chan func()
+	// pending is the number of queries waiting to be received.
+	pending int32
+	closed  chan struct{}
+}
+
+// NewRunner starts the goroutine that owns d. d must not be used
+// directly anymore.
+func NewRunner(d *Driver) *Runner {
+	r := &Runner{
+		driver:   d,
+		commands: make(chan func()),
+		queries:  make(chan func()),
+		closed:   make(chan struct{}),
+	}
+	d.serveQueries = r.serveQueries
+	go r.loop()
+	return r
+}
+
+func (r *Runner) loop() {
+	for {
+		select {
+		case f := <-r.commands:
+			f()
+		case f := <-r.queries:
+			atomic.AddInt32(&r.pending, -1)
+			f()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// serveQueries answers the queries that are waiting while a command runs
+// the VM.
+func (r *Runner) serveQueries() {
+	for atomic.LoadInt32(&r.pending) > 0 {
+		select {
+		case f := <-r.queries:
+			atomic.AddInt32(&r.pending, -1)
+			f()
+		default:
+			// The query is counted but not sent yet.
+			return
+		}
+	}
+}
+
+// Do runs f with the driver after the commands submitted before and waits
+// for it to return.
+func (r *Runner) Do(f func(d *Driver)) {
+	r.submit(r.commands, f)
+}
+
+// Query runs f with the driver as soon as the runner is idle or the VM is
+// between two instructions. f must not run the VM.
+func (r *Runner) Query(f func(d *Driver)) {
+	atomic.AddInt32(&r.pending, 1)
+	if !r.submit(r.queries, f) {
+		atomic.AddInt32(&r.pending, -1)
+	}
+}
+
+func (r *Runner) submit(ch chan func(), f func(d *Driver)) bool {
+	done := make(chan struct{})
+	var p any
+	wrapped := func() {
+		defer close(done)
+		defer func() {
+			p = recover()
+		}()
+		f(r.driver)
+	}
+
+	select {
+	case ch <- wrapped:
+	case <-r.closed:
+		return false
+	}
+	<-done
+	if p != nil {
+		panic(p)
+	}
+	return true
+}
+
+// Cancel interrupts the command that is running the VM, if any.
+func (r *Runner) Cancel() {
+	r.driver.Cancel()
+}
+
+// Close stops the runner.
+func (r *Runner) Close() {
+	close(r.closed)
+}
@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Timeline collects the calls of a trace and writes them as Chrome trace
+// events. A microsecond on the timeline is an instruction of the program.
+type Timeline struct {
+	events []timelineEvent
+	// open is the number of calls that did not return yet.
+	open int
+	// end is the clock of the last entry.
+	end int
+}
+
+// timelineEvent is a trace event, see "Trace Event Format" in the
+// documentation of the Catapult project.
+type timelineEvent struct {
+	Name  string         `json:"name"`
+	Cat   string         `json:"cat"`
+	Phase string         `json:"ph"`
+	Time  int            `json:"ts"`
+	Pid   int            `json:"pid"`
+	Tid   int            `json:"tid"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+func NewTimeline() *Timeline {
+	return &Timeline{}
+}
+
+// Add adds a call or a return to the timeline. A call begins an event
+// that its return ends, the nesting of the calls follows from the order.
+func (t *Timeline) Add(entry TraceEntry) {
+	event := timelineEvent{Name: entry.Function, Cat: "call", Time: entry.Instruction, Pid: 1, Tid: 1}
+	if event.Name == "" {
+		event.Name = "anonymous"
+	}
+	switch entry.Kind {
+	case "call":
+		event.Phase = "B"
+		args := map[string]any{}
+		for _, arg := range entry.Arguments {
+			args[arg.Name] = arg.Value
+		}
+		site := fmt.Sprintf("line %d", entry.Line)
+		if entry.Source != "" {
+			site = fmt.Sprintf("%s:%d", filepath.Base(entry.Source), entry.Line)
+		}
+		args["call site"] = site
+		event.Args = args
+		t.open++
+	case "return":
+		if t.open == 0 {
+			return
+		}
+		event.Phase = "E"
+		event.Args = map[string]any{"value": entry.Value, "instructions": entry.Instructions}
+		t.open--
+	}
+	t.events = append(t.events, event)
+	t.end = entry.Instruction
+}
+
+// Write writes the timeline as a JSON object. Calls that did not return,
+// because the program failed or was stopped, end at the last entry.
+func (t *Timeline) Write(w io.Writer) error {
+	events := append([]timelineEvent{}, t.events...)
+	for i := 0; i < t.open; i++ {
+		events = append(events, timelineEvent{Cat: "call", Phase: "E", Time: t.end, Pid: 1, Tid: 1})
+	}
+	return json.NewEncoder(w).Encode(map[string]any{
+		"traceEvents": events,
+		"otherData":   map[string]string{"clock": "instructions"},
+	})
+}
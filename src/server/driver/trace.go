@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"github.com/moritz-tiesler/monkey/compiler"
+	"github.com/moritz-tiesler/monkey/vm"
+)
+
+// TraceEntry is a function entry or exit that the driver records in
+// tracing mode, see Driver.Trace.
+type TraceEntry struct {
+	// Kind is "call" or "return".
+	Kind     string `json:"kind"`
+	Function string `json:"function"`
+	// Depth is the number of calls in progress including this one, 1 for
+	// a function called by the main program.
+	Depth int `json:"depth"`
+	// Source and Line are the call site, for the return as well.
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line"`
+	// Arguments are the arguments of a call.
+	Arguments []TraceArgument `json:"arguments,omitempty"`
+	// Value is the value a function returned. Instructions is the number
+	// of instructions the call executed, including the functions it
+	// called.
+	Value        string `json:"value,omitempty"`
+	Instructions int    `json:"instructions,omitempty"`
+	// Instruction is the number of instructions the program executed
+	// before the call started or returned, a clock that does not advance
+	// while the program is paused.
+	Instruction int `json:"instruction"`
+}
+
+// TraceArgument is an argument of a traced call.
+type TraceArgument struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// observeCalls reports the call or return since the previous cycle to
+// Trace and keeps the return value during a step.
+func (d *Driver) observeCalls(machine *vm.VM) {
+	depth := machine.FramesIndex() - 1
+	previous := d.depth
+	d.depth = depth
+	if depth < previous && d.keepReturns {
+		// The return value has been pushed onto the stack of the caller.
+		d.returnValue = machine.StackTop()
+		d.returnFrame = machine.CurrentFrame()
+	}
+	if d.Trace == nil {
+		d.calls = nil
+		return
+	}
+
+	switch {
+	case depth > previous:
+		frame := machine.CurrentFrame()
+		caller := machine.Frames()[depth-1]
+		site := d.FileLocation(callSite(machine, caller).Range.Start.Line)
+		entry := TraceEntry{
+			Kind:        "call",
+			Function:    frame.Name(),
+			Depth:       depth,
+			Source:      site.Source,
+			Line:        site.Line,
+			Instruction: d.instructions,
+		}
+		bindings := d.frameBindings(frame)
+		for _, b := range bindings[:frame.Closure().Fn.NumParameters] {
+			entry.Arguments = append(entry.Arguments, TraceArgument{Name: b.name, Value: FormatValue(b.value, ValueFormat{})})
+		}
+		d.calls = append(d.calls, entry)
+		d.Trace(entry)
+	case depth < previous:
+		n := len(d.calls)
+		if n == 0 || d.calls[n-1].Depth != previous {
+			return
+		}
+		entry := d.calls[n-1]
+		d.calls = d.calls[:n-1]
+		entry.Kind = "return"
+		entry.Arguments = nil
+		// The return value has been pushed onto the stack of the caller.
+		entry.Value = FormatValue(machine.StackTop(), ValueFormat{})
+		entry.Instructions = d.instructions - entry.Instruction
+		entry.Instruction = d.instructions
+		d.Trace(entry)
+	}
+}
+
+// callSite returns the location of the call that caller is executing. The
+// location of a call is recorded before its OpCall, so unlike
+// sourceLocation the closest recorded instruction before it is used.
+func callSite(machine *vm.VM, caller *vm.Frame) compiler.LocationData {
+	fn := caller.Closure().Fn
+	for i := caller.Ip; i >= 0; i-- {
+		if loc, ok := machine.LocationMap[compiler.LocationKey{ScopeId: fn, InstructionIndex: i}]; ok {
+			return loc
+		}
+	}
+	return sourceLocation(machine, caller, caller.Ip)
+}
@@ -1,39 +1,84 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 	"sync"
-	"time"
 
 	"monkeylang-debug/driver"
 
 	"github.com/google/go-dap"
+	"github.com/moritz-tiesler/monkey/exception"
+	"github.com/moritz-tiesler/monkey/object"
+	"github.com/moritz-tiesler/monkey/vm"
 )
 
 type MonkeyHandler struct {
-	session             *Session
-	Driver              *driver.Driver
-	bpSetMux            sync.Mutex
-	terminateOnNextStep bool
+	session *Session
+	// runner owns the driver. Fields that are only used together with
+	// the driver, like launchArgs and started, are only accessed on the
+	// runner as well.
+	runner *driver.Runner
+	// launched and configured are set by the launch and configurationDone
+	// requests. The program is started once both arrived.
+	launched   bool
+	configured bool
+	started    bool
+	// deferred is an error of the program reported before it started.
+	deferred driver.Event
+	// held are the events of a run request that has not been answered
+	// yet, if holding is set.
+	holding bool
+	held    []driver.Event
+	// gotoTargets are the targets handed out by gotoTargets requests.
+	// Target id n refers to gotoTargets[n-1].
+	gotoTargets      []driver.Location
+	supportsProgress bool
+	columnsStartAt1  bool
+	launchArgs       launchArgs
+	// traceFile is the open trace file of the launch configuration,
+	// timeline collects the calls for its timeline.
+	traceFile *os.File
+	timeline  *driver.Timeline
+	sources   *sourceStore
+	log       Logger
+
+	// op is the cancellable run that is currently in progress, if any.
+	// cancelledSeqs are the requests that were cancelled before their
+	// run started.
+	opMux         sync.Mutex
+	op            *operation
+	cancelledSeqs map[int]bool
 }
 
 func NewHandler() MonkeyHandler {
 	return MonkeyHandler{
-		Driver: driver.New(),
+		runner:        driver.NewRunner(driver.New()),
+		sources:       newSourceStore(),
+		cancelledSeqs: map[int]bool{},
 	}
 }
 
+// SetSession connects the handler to a session and subscribes it to the
+// events of the driver. The handler must not be copied afterwards.
 func (h *MonkeyHandler) SetSession(s *Session) {
 	h.session = s
+	h.runner.Do(func(d *driver.Driver) {
+		d.Subscribe(func(e driver.Event) {
+			h.onEvent(d, e)
+		})
+	})
 }
 
 func (h *MonkeyHandler) OnInitializeRequest(request *dap.InitializeRequest) {
 	response := &dap.InitializeResponse{}
 	response.Response = *newResponse(request.Seq, request.Command)
+	h.supportsProgress = request.Arguments.SupportsProgressReporting
+	h.columnsStartAt1 = request.Arguments.ColumnsStartAt1
 	response.Body.SupportsConfigurationDoneRequest = true
-	response.Body.SupportsFunctionBreakpoints = false
+	response.Body.SupportsFunctionBreakpoints = true
 	response.Body.SupportsConditionalBreakpoints = false
 	response.Body.SupportsHitConditionalBreakpoints = false
 	response.Body.SupportsEvaluateForHovers = false
@@ -41,28 +86,28 @@ func (h *MonkeyHandler) OnInitializeRequest(request *dap.InitializeRequest) {
 	response.Body.SupportsStepBack = false
 	response.Body.SupportsSetVariable = false
 	response.Body.SupportsRestartFrame = false
-	response.Body.SupportsGotoTargetsRequest = false
+	response.Body.SupportsGotoTargetsRequest = true
 	response.Body.SupportsStepInTargetsRequest = false
-	response.Body.SupportsCompletionsRequest = false
-	response.Body.CompletionTriggerCharacters = []string{}
+	response.Body.SupportsCompletionsRequest = true
+	response.Body.CompletionTriggerCharacters = []string{"."}
 	response.Body.SupportsModulesRequest = false
 	response.Body.AdditionalModuleColumns = []dap.ColumnDescriptor{}
 	response.Body.SupportedChecksumAlgorithms = []dap.ChecksumAlgorithm{}
-	response.Body.SupportsRestartRequest = false
+	response.Body.SupportsRestartRequest = true
 	response.Body.SupportsExceptionOptions = false
-	response.Body.SupportsValueFormattingOptions = false
+	response.Body.SupportsValueFormattingOptions = true
 	response.Body.SupportsExceptionInfoRequest = true
-	response.Body.SupportTerminateDebuggee = false
-	response.Body.SupportsDelayedStackTraceLoading = false
-	response.Body.SupportsLoadedSourcesRequest = false
+	response.Body.SupportTerminateDebuggee = true
+	response.Body.SupportsDelayedStackTraceLoading = true
+	response.Body.SupportsLoadedSourcesRequest = true
 	response.Body.SupportsLogPoints = false
 	response.Body.SupportsTerminateThreadsRequest = false
 	response.Body.SupportsSetExpression = false
-	response.Body.SupportsTerminateRequest = false
-	response.Body.SupportsDataBreakpoints = false
+	response.Body.SupportsTerminateRequest = true
+	response.Body.SupportsDataBreakpoints = true
 	response.Body.SupportsReadMemoryRequest = false
 	response.Body.SupportsDisassembleRequest = false
-	response.Body.SupportsCancelRequest = false
+	response.Body.SupportsCancelRequest = true
 	response.Body.SupportsBreakpointLocationsRequest = false
 	// This is a fake set up, so we can start "accepting" configuration
 	// requests for setting breakpoints, etc from the client at any time.
@@ -73,76 +118,360 @@ func (h *MonkeyHandler) OnInitializeRequest(request *dap.InitializeRequest) {
 	h.session.send(response)
 }
 
+// launchArgs are the attributes of a launch configuration that are
+// understood by the adapter.
+type launchArgs struct {
+	Program string `json:"program"`
+	// Source is the text of a program that is not saved to disk. It is
+	// only used if Program is empty.
+	Source string `json:"source"`
+
+	// LogLevel and LogComponents override the log options of the adapter.
+	LogLevel      string   `json:"logLevel"`
+	LogComponents []string `json:"logComponents"`
+	// LogToConsole sends the logs to the debug console.
+	LogToConsole bool `json:"logToConsole"`
+	// StopOnEntry pauses the program before its first instruction.
+	StopOnEntry bool `json:"stopOnEntry"`
+	// NoDebug runs the program without stopping, a runtime error ends the
+	// session with exit code 1.
+	NoDebug bool `json:"noDebug"`
+	// MaxCallDepth and MaxInstructions limit the call depth and the number
+	// of instructions of the program, see driver.Driver.
+	MaxCallDepth    int `json:"maxCallDepth"`
+	MaxInstructions int `json:"maxInstructions"`
+	// MaxValueLength is the number of characters after which values are
+	// cut off, driver.DefaultMaxValueLength if 0.
+	MaxValueLength int `json:"maxValueLength"`
+	// TraceFile is a file that every function call and return is written
+	// to as a line of JSON. TraceToConsole shows them in the debug
+	// console.
+	TraceFile      string `json:"traceFile"`
+	TraceToConsole bool   `json:"traceToConsole"`
+	// Profile is a file that a pprof profile of the instructions and the
+	// time spent per line and function is written to.
+	Profile string `json:"profile"`
+	// Coverage is an LCOV file that the lines the program executed are
+	// written to.
+	Coverage string `json:"coverage"`
+	// Timeline is a file that the calls of the program are written to as
+	// Chrome trace events.
+	Timeline string `json:"timeline"`
+}
+
 func (h *MonkeyHandler) OnLaunchRequest(request *dap.LaunchRequest) {
-	code, err := os.ReadFile(h.session.source.Path)
-	if err != nil {
-		panic(fmt.Sprintf("could not read source file=%s", h.session.source.Path))
+	var args launchArgs
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		h.session.send(newErrorResponse(request.Seq, request.Command, errInvalidArguments, fmt.Sprintf("could not parse launch arguments: %s", err)))
+		return
 	}
+	if args.Program == "" && args.Source == "" {
+		h.session.send(newErrorResponse(request.Seq, request.Command, errInvalidArguments, "launch configuration needs a program or a source attribute"))
+		return
+	}
+	h.configureLogs(args)
+
+	h.runner.Do(func(d *driver.Driver) {
+		h.launchArgs = args
+		h.resetProgram(d)
+		h.configureTrace(d)
+		h.configureProfile(d)
+		h.configureCoverage(d)
+		err := h.loadProgram(d)
+		if err != nil && !d.HasErrors() {
+			h.session.send(newErrorResponse(request.Seq, request.Command, errLaunchFailed, fmt.Sprintf("could not read source file=%s: %s", args.Program, err)))
+			return
+		}
+		h.launched = true
 
-	err = h.Driver.StartVM(string(code))
-	if err != nil {
 		response := &dap.LaunchResponse{}
 		response.Response = *newResponse(request.Seq, request.Command)
 		h.session.send(response)
-		log.Printf("could not start vm: %s", err)
-
-		go func() {
-			time.Sleep(200 * time.Millisecond)
-			s := h.Driver.State()
-			log.Printf("State: %d", s)
-			switch s {
-			case driver.OFF:
-			default:
-				e := h.ProduceStopEvent(h.Driver.State())
-				h.session.send(e)
-			}
-		}()
-		return
+
+		h.announceSources(d, nil)
+		h.startProgram(d, request.Seq)
+	})
+}
+
+// configureLogs applies the log options of a launch configuration.
+func (h *MonkeyHandler) configureLogs(args launchArgs) {
+	logs := h.session.logs
+	if args.LogLevel != "" {
+		level, err := ParseLevel(args.LogLevel)
+		if err != nil {
+			h.log.Errorf("%s", err)
+		} else {
+			logs.setLevel(level)
+		}
 	}
-	log.Printf("started vm with code=%s\n", string(code))
+	if len(args.LogComponents) > 0 {
+		components, err := ParseComponents(strings.Join(args.LogComponents, ","))
+		if err != nil {
+			h.log.Errorf("%s", err)
+		} else {
+			logs.setComponents(components)
+		}
+	}
+	if args.LogToConsole {
+		logs.setConsole(func(message string) {
+			h.session.send(&dap.OutputEvent{
+				Event: *newEvent("output"),
+				Body: dap.OutputEventBody{
+					Category: "console",
+					Output:   message + "\n",
+				},
+			})
+		})
+	}
+}
+
+// loadProgram starts a VM for the program of the launch configuration,
+// with its limits.
+func (h *MonkeyHandler) loadProgram(d *driver.Driver) error {
+	d.MaxCallDepth = h.launchArgs.MaxCallDepth
+	d.MaxInstructions = h.launchArgs.MaxInstructions
+	if h.launchArgs.Program == "" {
+		return d.LoadSource(h.launchArgs.Source)
+	}
+	return d.Load(h.launchArgs.Program)
+}
 
-	go func() {
-		time.Sleep(200 * time.Millisecond)
-		err, hit := h.Driver.RunWithBreakpoints(h.Driver.Breakpoints)
+// startProgram runs the program once it was launched and configured. It
+// is called on the runner.
+func (h *MonkeyHandler) startProgram(d *driver.Driver, requestSeq int) {
+	if !h.launched || !h.configured || h.started {
+		return
+	}
+	h.started = true
+	if h.deferred != nil {
+		h.onEvent(d, h.deferred)
+		h.deferred = nil
+		return
+	}
+	if d.VM == nil {
+		return
+	}
+	if h.launchArgs.NoDebug {
+		h.advance(d, requestSeq, "Running program", func() (error, bool) {
+			return d.RunWithBreakpoints(nil)
+		})
+		return
+	}
+	if h.launchArgs.StopOnEntry {
+		err := d.PauseOnEntry()
 		if err != nil {
-			log.Printf("error runnig VM: %s", err)
+			h.log.Errorf("could not pause on entry: %s", err)
 		}
-		log.Printf("bp hit=%v", hit)
-		log.Printf("Ran VM until %v\n", h.Driver.VM.SourceLocation())
-		log.Printf("VM state=%s", h.Driver.State().String())
-		log.Printf("VM pointer=%d", h.Driver.VM.CurrentFrame().Ip)
+		return
+	}
+	h.log.Debugf("starting vm with code=%s", d.SourceCode)
+	h.advance(d, requestSeq, "Running program", func() (error, bool) {
+		return d.Continue()
+	})
+}
 
-		switch h.Driver.State() {
-		case driver.OFF:
-			return
+// onEvent tells the client about the transitions of the program. Events
+// of a program that was not started yet are held back until it starts.
+// It is called on the runner.
+func (h *MonkeyHandler) onEvent(d *driver.Driver, e driver.Event) {
+	if e, ok := e.(driver.BreakpointChanged); ok {
+		// Breakpoints are placed when the program is loaded, the client
+		// learns about them before the program starts.
+		h.session.send(&dap.BreakpointEvent{
+			Event: *newEvent("breakpoint"),
+			Body:  dap.BreakpointEventBody{Reason: "changed", Breakpoint: toBreakpoint(e.Breakpoint)},
+		})
+		return
+	}
+	if !h.started {
+		if _, ok := e.(driver.Errored); ok {
+			h.deferred = e
+		}
+		return
+	}
+	if h.holding {
+		h.held = append(h.held, e)
+		return
+	}
+	h.endProgress()
+
+	switch e := e.(type) {
+	case driver.StoppedOnBreakpoint:
+		body := dap.StoppedEventBody{Reason: "breakpoint", Description: "Paused on breakpoint", HitBreakpointIds: e.Ids}
+		switch {
+		case e.Function != "":
+			body.Reason = "function breakpoint"
+			body.Description = "Paused on function breakpoint"
+			body.Text = e.Function
+		case e.Binding != "":
+			body.Reason = "data breakpoint"
+			body.Description = "Paused on data breakpoint"
+			body.Text = fmt.Sprintf("%s = %s", e.Binding, driver.ObjectToDriverVar(e.Value, e.Binding).Value)
+		}
+		h.sendStopped(body)
+	case driver.StepCompleted:
+		h.sendStopped(dap.StoppedEventBody{Reason: "step", Description: "Paused after step"})
+	case driver.Paused:
+		// The VM is left before the next instruction, so the program
+		// can be continued from there.
+		switch e.Reason {
+		case driver.PausedOnEntry:
+			h.sendStopped(dap.StoppedEventBody{Reason: "entry", Description: "Paused on entry"})
+		case driver.PausedAfterGoto:
+			h.sendStopped(dap.StoppedEventBody{Reason: "goto", Description: "Paused after goto"})
 		default:
-			e := h.ProduceStopEvent(h.Driver.State())
-			h.session.send(e)
+			h.sendStopped(dap.StoppedEventBody{Reason: "pause", Description: "Paused"})
+		}
+	case driver.Errored:
+		h.writeReports(d)
+		if h.launchArgs.NoDebug {
+			// Without a debugger there is nothing to inspect, the error
+			// ends the program.
+			source := h.sourceFor(d, e.Location.Source)
+			h.session.send(&dap.OutputEvent{
+				Event: *newEvent("output"),
+				Body:  dap.OutputEventBody{Category: "stderr", Output: e.Err.Error() + "\n", Source: &source, Line: e.Location.Line},
+			})
+			h.sendExited(d.ExitCode())
+			return
 		}
-	}()
+		h.sendStopped(dap.StoppedEventBody{Reason: "exception", Description: "Paused on exception", Text: e.Err.Error()})
+	case driver.Exited:
+		h.writeReports(d)
+		h.sendExited(e.Code)
+	}
+}
 
-	response := &dap.LaunchResponse{}
-	response.Response = *newResponse(request.Seq, request.Command)
-	h.session.send(response)
+// sendStopped tells the client that the program stopped. body holds the
+// reason and a description that is shown to the user, its Text adds
+// details like the name of the function breakpoint or the error message.
+func (h *MonkeyHandler) sendStopped(body dap.StoppedEventBody) {
+	body.ThreadId = 1
+	body.AllThreadsStopped = true
+	h.session.send(&dap.StoppedEvent{Event: *newEvent("stopped"), Body: body})
+}
+
+// sendExited tells the client that the program ended with code and that
+// the debug session is over.
+func (h *MonkeyHandler) sendExited(code int) {
+	h.session.send(&dap.ExitedEvent{
+		Event: *newEvent("exited"),
+		Body:  dap.ExitedEventBody{ExitCode: code},
+	})
+	h.session.send(&dap.TerminatedEvent{Event: *newEvent("terminated")})
+}
+
+// cancelRun cancels the run that is currently in progress, if any.
+func (h *MonkeyHandler) cancelRun() {
+	h.opMux.Lock()
+	if h.op != nil {
+		h.runner.Cancel()
+	}
+	h.opMux.Unlock()
+}
+
+// resetProgram discards the VM. It is called on the runner.
+func (h *MonkeyHandler) resetProgram(d *driver.Driver) {
+	d.Reset()
+	h.sources.reset()
+	h.started = false
+	h.deferred = nil
+	h.opMux.Lock()
+	clear(h.cancelledSeqs)
+	h.opMux.Unlock()
+}
+
+// stopProgram cancels the run that is currently in progress and discards
+// the VM once the run returned.
+func (h *MonkeyHandler) stopProgram() {
+	h.cancelRun()
+	h.runner.Do(h.resetProgram)
 }
 
 func (h *MonkeyHandler) OnAttachRequest(request *dap.AttachRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "AttachRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "AttachRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnDisconnectRequest(request *dap.DisconnectRequest) {
+	// The program runs inside the adapter, so it is terminated unless the
+	// client explicitly asks to keep it alive. In that case it runs to
+	// completion without stopping at breakpoints.
+	terminate := request.Arguments == nil || request.Arguments.TerminateDebuggee
+	if terminate {
+		h.stopProgram()
+	}
+
 	response := &dap.DisconnectResponse{}
 	response.Response = *newResponse(request.Seq, request.Command)
-	h.session.stopDebug <- struct{}{}
+	h.session.stop()
 	h.session.send(response)
+
+	if !terminate {
+		h.runner.Do(func(d *driver.Driver) {
+			if d.VM == nil {
+				return
+			}
+			// The client is gone, so the events of the run are dropped.
+			h.started = false
+			err, _ := d.RunWithBreakpoints(nil)
+			if err != nil {
+				h.log.Errorf("error running VM after disconnect: %s", err)
+			}
+		})
+	}
+	// The reports are complete once the program ended or was stopped.
+	h.runner.Do(func(d *driver.Driver) {
+		h.closeTrace(d)
+		h.writeReports(d)
+	})
 }
 
 func (h *MonkeyHandler) OnTerminateRequest(request *dap.TerminateRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "TerminateRequest is not yet supported"))
+	h.stopProgram()
+
+	response := &dap.TerminateResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.session.send(response)
+
+	e := &dap.TerminatedEvent{Event: *newEvent("terminated")}
+	h.session.send(e)
 }
 
 func (h *MonkeyHandler) OnRestartRequest(request *dap.RestartRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "RestartRequest is not yet supported"))
+	// The client may send an updated launch configuration.
+	var restartArgs struct {
+		Arguments *launchArgs `json:"arguments"`
+	}
+	if len(request.Arguments) > 0 {
+		if err := json.Unmarshal(request.Arguments, &restartArgs); err != nil {
+			h.log.Errorf("could not parse restart arguments: %s", err)
+		}
+	}
+
+	h.cancelRun()
+	h.runner.Do(func(d *driver.Driver) {
+		if args := restartArgs.Arguments; args != nil && (args.Program != "" || args.Source != "") {
+			h.launchArgs = *args
+		}
+
+		previous := d.Files
+		h.resetProgram(d)
+		h.configureTrace(d)
+		h.configureProfile(d)
+		h.configureCoverage(d)
+		err := h.loadProgram(d)
+		if err != nil && !d.HasErrors() {
+			h.session.send(newErrorResponse(request.Seq, request.Command, errLaunchFailed, fmt.Sprintf("could not read source file=%s: %s", h.launchArgs.Program, err)))
+			return
+		}
+
+		response := &dap.RestartResponse{}
+		response.Response = *newResponse(request.Seq, request.Command)
+		h.session.send(response)
+
+		h.announceSources(d, previous)
+		h.startProgram(d, request.Seq)
+	})
 }
 
 func (h *MonkeyHandler) OnSetBreakpointsRequest(request *dap.SetBreakpointsRequest) {
@@ -151,24 +480,49 @@ func (h *MonkeyHandler) OnSetBreakpointsRequest(request *dap.SetBreakpointsReque
 	for i, bp := range bps {
 		lines[i] = bp.Line
 	}
-	h.Driver.SetBreakPoints(lines)
-
-	source := request.Arguments.Source
-	h.Driver.Source = source.Path
-	h.session.source = source
+	var set []driver.Breakpoint
+	h.runner.Query(func(d *driver.Driver) {
+		set = d.SetBreakPointsInSource(request.Arguments.Source.Path, lines)
+	})
 
 	response := &dap.SetBreakpointsResponse{}
 	response.Response = *newResponse(request.Seq, request.Command)
-	response.Body.Breakpoints = make([]dap.Breakpoint, len(request.Arguments.Breakpoints))
-	for i, b := range request.Arguments.Breakpoints {
-		response.Body.Breakpoints[i].Line = b.Line
-		response.Body.Breakpoints[i].Verified = true
+	response.Body.Breakpoints = make([]dap.Breakpoint, len(set))
+	for i, bp := range set {
+		response.Body.Breakpoints[i] = toBreakpoint(bp)
 	}
 	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnSetFunctionBreakpointsRequest(request *dap.SetFunctionBreakpointsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "SetFunctionBreakpointsRequest is not yet supported"))
+	bps := request.Arguments.Breakpoints
+	names := make([]string, len(bps))
+	for i, bp := range bps {
+		names[i] = bp.Name
+	}
+	var set []driver.Breakpoint
+	h.runner.Query(func(d *driver.Driver) {
+		set = d.SetFunctionBreakpoints(names)
+	})
+
+	response := &dap.SetFunctionBreakpointsResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body.Breakpoints = make([]dap.Breakpoint, len(set))
+	for i, bp := range set {
+		response.Body.Breakpoints[i] = toBreakpoint(bp)
+	}
+	h.session.send(response)
+}
+
+// toBreakpoint converts a breakpoint of the driver. Function breakpoints
+// have no line.
+func toBreakpoint(bp driver.Breakpoint) dap.Breakpoint {
+	return dap.Breakpoint{
+		Id:       bp.Id,
+		Verified: bp.Verified,
+		Line:     bp.Line,
+		Message:  bp.Message,
+	}
 }
 
 func (h *MonkeyHandler) OnSetExceptionBreakpointsRequest(request *dap.SetExceptionBreakpointsRequest) {
@@ -183,152 +537,168 @@ func (h *MonkeyHandler) OnConfigurationDoneRequest(request *dap.ConfigurationDon
 	response := &dap.ConfigurationDoneResponse{}
 	response.Response = *newResponse(request.Seq, request.Command)
 	h.session.send(response)
-}
-
-func (h *MonkeyHandler) OnContinueRequest(request *dap.ContinueRequest) {
-	response := &dap.ContinueResponse{}
-	response.Response = *newResponse(request.Seq, request.Command)
-	h.session.send(response)
 
-	h.bpSetMux.Lock()
+	h.runner.Do(func(d *driver.Driver) {
+		h.configured = true
+		h.startProgram(d, request.Seq)
+	})
+}
 
-	bps := h.Driver.Breakpoints
-	log.Printf("Breakpoints: %v", bps)
-	err, _ := h.Driver.RunWithBreakpoints(bps)
-	if err != nil {
-		log.Printf("error runnig VM: %s", err)
-	}
-	log.Printf("Ran VM until %v\n", h.Driver.VM.SourceLocation())
+// run advances the program with step on the runner and answers the run
+// request with response before the events of the step are sent.
+func (h *MonkeyHandler) run(request *dap.Request, response dap.Message, title string, step func(d *driver.Driver) (error, bool)) {
+	h.runner.Do(func(d *driver.Driver) {
+		switch d.State() {
+		case driver.NOT_STARTED, driver.PAUSED:
+			if d.VM == nil {
+				h.session.send(newErrorResponse(request.Seq, request.Command, errNotLaunched, "the program has not been launched"))
+				return
+			}
+		case driver.COMPILER_ERROR, driver.RUNTIME_ERROR:
+			// A failed program stays where it failed, so that it can be
+			// inspected. Continuing ends it, steps are refused.
+			if d.State() == driver.RUNTIME_ERROR && request.Command != "continue" {
+				err, _ := step(d)
+				h.session.send(newErrorResponse(request.Seq, request.Command, errProgramFailed, err.Error()))
+				return
+			}
+			h.session.send(response)
+			h.sendExited(d.ExitCode())
+			return
+		default:
+			h.session.send(newErrorResponse(request.Seq, request.Command, errNotStopped, fmt.Sprintf("the program cannot be run in state=%s", d.State())))
+			return
+		}
+		h.holding = true
+		cancelled := h.advance(d, request.Seq, title, func() (error, bool) {
+			return step(d)
+		})
+		h.holding = false
+		if cancelled {
+			h.session.send(newErrorResponse(request.Seq, request.Command, errCancelled, fmt.Sprintf("%s was cancelled", request.Command)))
+		} else {
+			h.session.send(response)
+		}
+		held := h.held
+		h.held = nil
+		for _, e := range held {
+			h.onEvent(d, e)
+		}
+	})
+}
 
-	s := h.Driver.State()
-	switch s {
-	case driver.OFF:
-		log.Printf("%d\n", s)
-		return
-	default:
-		log.Printf("%d\n", s)
-		e := h.ProduceStopEvent(s)
-		h.session.send(e)
+// advance runs step as a cancellable operation and reports whether a
+// cancel request stopped it. The client learns where the program stopped
+// from the events of the driver. It is called on the runner.
+func (h *MonkeyHandler) advance(d *driver.Driver, requestSeq int, title string, step func() (error, bool)) bool {
+	err, cancelled := h.track(d, requestSeq, title, func() error {
+		err, _ := step()
+		return err
+	})
+	if err != nil && err != driver.ErrCancelled {
+		h.log.Errorf("error running VM: %s", err)
 	}
+	h.log.Debugf("state=%s", d.State())
+	return cancelled
+}
 
-	h.bpSetMux.Unlock()
+func (h *MonkeyHandler) OnContinueRequest(request *dap.ContinueRequest) {
+	response := &dap.ContinueResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.run(&request.Request, response, "Running program", func(d *driver.Driver) (error, bool) {
+		h.log.Debugf("Breakpoints: %v", d.Breakpoints)
+		return d.Continue()
+	})
 }
 
 func (h *MonkeyHandler) OnNextRequest(request *dap.NextRequest) {
-	acknowledgement := &dap.NextResponse{}
-	acknowledgement.Response = *newResponse(request.Seq, request.Command)
-	h.session.send(acknowledgement)
-
-	log.Printf("sent acknowledgement")
-
-	command := request.Command
-	log.Printf("Received command=%s", command)
-	err, _ := h.Driver.StepOver()
-	log.Printf("Ran VM until %v\n", h.Driver.VM.SourceLocation())
-	log.Printf("VM State=%s", h.Driver.State().String())
-
-	if err != nil {
-		log.Printf("error handling NextRequest: %s", err)
-	}
-
-	switch h.Driver.State() {
-	case driver.OFF:
-		return
-	default:
-		e := h.ProduceStopEvent(h.Driver.State())
-		h.session.send(e)
-	}
-
+	response := &dap.NextResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.run(&request.Request, response, "Stepping over", (*driver.Driver).StepOver)
 }
 
 func (h *MonkeyHandler) OnStepInRequest(request *dap.StepInRequest) {
-	acknowledgement := &dap.StepInResponse{}
-	acknowledgement.Response = *newResponse(request.Seq, request.Command)
-	h.session.send(acknowledgement)
-
-	log.Printf("sent acknowledgement")
-
-	command := request.Command
-	log.Printf("Received command=%s", command)
-	err, _ := h.Driver.StepInto()
-	log.Printf("Ran VM until %v\n", h.Driver.VM.SourceLocation())
-	log.Printf("VM State=%s", h.Driver.State().String())
-
-	if err != nil {
-		log.Printf("error handling NextRequest: %s", err)
-	}
-
-	switch h.Driver.State() {
-	case driver.OFF:
-		return
-	default:
-		e := h.ProduceStopEvent(h.Driver.State())
-		h.session.send(e)
-	}
-
+	response := &dap.StepInResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.run(&request.Request, response, "Stepping into", (*driver.Driver).StepInto)
 }
 
 func (h *MonkeyHandler) OnStepOutRequest(request *dap.StepOutRequest) {
-	acknowledgement := &dap.StepOutResponse{}
-	acknowledgement.Response = *newResponse(request.Seq, request.Command)
-	h.session.send(acknowledgement)
-
-	log.Printf("sent acknowledgement")
-
-	command := request.Command
-	log.Printf("Received command=%s", command)
-	err, _ := h.Driver.StepOut()
-	log.Printf("Ran VM until %v\n", h.Driver.VM.SourceLocation())
-	log.Printf("VM State=%s", h.Driver.State().String())
-
-	if err != nil {
-		log.Printf("error handling NextRequest: %s", err)
-	}
-
-	switch h.Driver.State() {
-	case driver.OFF:
-		return
-	default:
-		e := h.ProduceStopEvent(h.Driver.State())
-		h.session.send(e)
-	}
+	response := &dap.StepOutResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.run(&request.Request, response, "Stepping out", (*driver.Driver).StepOut)
 }
 
 func (h *MonkeyHandler) OnStepBackRequest(request *dap.StepBackRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "StepBackRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "StepBackRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnReverseContinueRequest(request *dap.ReverseContinueRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "ReverseContinueRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "ReverseContinueRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnRestartFrameRequest(request *dap.RestartFrameRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "RestartFrameRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "RestartFrameRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnGotoRequest(request *dap.GotoRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "GotoRequest is not yet supported"))
+	h.runner.Do(func(d *driver.Driver) {
+		id := request.Arguments.TargetId
+		if id < 1 || id > len(h.gotoTargets) {
+			h.session.send(newErrorResponse(request.Seq, request.Command, errInvalidReference, fmt.Sprintf("unknown goto target=%d", id)))
+			return
+		}
+		target := h.gotoTargets[id-1]
+		// The stopped event is sent after the response.
+		if !d.CanGoto(target.Source, target.Line) {
+			h.session.send(newErrorResponse(request.Seq, request.Command, errNotStopped, fmt.Sprintf("cannot jump to line %d", target.Line)))
+			return
+		}
+		response := &dap.GotoResponse{}
+		response.Response = *newResponse(request.Seq, request.Command)
+		h.session.send(response)
+		err := d.Goto(target.Source, target.Line)
+		if err != nil {
+			h.log.Errorf("could not jump to line %d: %s", target.Line, err)
+		}
+	})
 }
 
+// OnPauseRequest interrupts the run that is in progress. The program is
+// already paused if there is none.
 func (h *MonkeyHandler) OnPauseRequest(request *dap.PauseRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "PauseRequest is not yet supported"))
+	h.cancelRun()
+	response := &dap.PauseResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnStackTraceRequest(request *dap.StackTraceRequest) {
+	h.runner.Query(func(d *driver.Driver) {
+		h.stackTrace(d, request)
+	})
+}
+
+func (h *MonkeyHandler) stackTrace(d *driver.Driver, request *dap.StackTraceRequest) {
 	response := &dap.StackTraceResponse{}
 	response.Response = *newResponse(request.Seq, request.Command)
 
-	ds := h.Driver.State()
-	log.Printf("Driver state: %v", ds)
-	switch ds {
-	case driver.COMPILER_ERROR:
-		e := h.Driver.Errors[0]
+	ds := d.State()
+	h.log.Debugf("Driver state: %v", ds)
+	switch {
+	case d.VM == nil && !d.HasErrors():
+		h.session.send(newErrorResponse(request.Seq, request.Command, errNotLaunched, "the program has not been launched"))
+		return
+	case d.VM == nil:
+		e := d.Errors[0]
+		loc := d.FileLocation(e.Line())
 		stackFrames := make([]dap.StackFrame, 1)
+		source := h.sourceFor(d, loc.Source)
 		stackFrames[0] = dap.StackFrame{
 			Id:     0,
 			Name:   "Compiler Error",
-			Source: &h.session.source,
-			Line:   e.Line(),
+			Source: &source,
+			Line:   loc.Line,
 			Column: e.Col(),
 		}
 		response.Body = dap.StackTraceResponseBody{
@@ -336,15 +706,20 @@ func (h *MonkeyHandler) OnStackTraceRequest(request *dap.StackTraceRequest) {
 			TotalFrames: 1,
 		}
 	default:
-		driverFrames := h.Driver.CollectFrames()
-		stackFrames := make([]dap.StackFrame, len(driverFrames))
-		// reverse the order: deepest stack frame must be first in array
-		for i := len(stackFrames) - 1; i >= 0; i-- {
-			stackFrames[i] = h.DriverFrameToStackFrame(driverFrames[len(stackFrames)-1-i])
+		driverFrames := d.CollectFrames()
+		// The client pages through deep stacks, the deepest frame first.
+		start := min(max(request.Arguments.StartFrame, 0), len(driverFrames))
+		end := len(driverFrames)
+		if levels := request.Arguments.Levels; levels > 0 {
+			end = min(start+levels, end)
+		}
+		stackFrames := make([]dap.StackFrame, end-start)
+		for i := range stackFrames {
+			stackFrames[i] = h.DriverFrameToStackFrame(d, driverFrames[len(driverFrames)-1-start-i], request.Arguments.Format)
 		}
 		response.Body = dap.StackTraceResponseBody{
 			StackFrames: stackFrames,
-			TotalFrames: len(stackFrames),
+			TotalFrames: len(driverFrames),
 		}
 	}
 
@@ -362,6 +737,19 @@ func (h *MonkeyHandler) OnScopesRequest(request *dap.ScopesRequest) {
 		localScope := dap.Scope{Name: "Local", VariablesReference: frameId + 1, Expensive: false}
 		scopes = append(scopes, localScope)
 	}
+	// The return value of a completed step and the operands of a failed
+	// instruction belong to main, not to the globals.
+	if frameId == 0 {
+		var local []driver.DriverVar
+		h.runner.Query(func(d *driver.Driver) {
+			if len(d.Frames) > 0 {
+				local, _ = splitMainVars(d.Frames[0].Vars)
+			}
+		})
+		if len(local) > 0 {
+			scopes = append(scopes, dap.Scope{Name: "Local", VariablesReference: mainLocalsReference, Expensive: false})
+		}
+	}
 	//always attach global scope
 	scopes = append(scopes, dap.Scope{Name: "Global", VariablesReference: 1, Expensive: false})
 
@@ -379,12 +767,32 @@ func (h *MonkeyHandler) OnScopesRequest(request *dap.ScopesRequest) {
 func (h *MonkeyHandler) OnVariablesRequest(request *dap.VariablesRequest) {
 	// subtract 1 from ref and use the value as an index into our driver frames
 	varRef := request.Arguments.VariablesReference - 1
+	var driverVars []driver.DriverVar
+	var format driver.ValueFormat
+	valid := false
+	h.runner.Query(func(d *driver.Driver) {
+		switch {
+		case request.Arguments.VariablesReference == mainLocalsReference && len(d.Frames) > 0:
+			driverVars, _ = splitMainVars(d.Frames[0].Vars)
+			valid = true
+		case varRef == 0 && len(d.Frames) > 0:
+			_, driverVars = splitMainVars(d.Frames[0].Vars)
+			valid = true
+		case varRef > 0 && varRef < len(d.Frames):
+			driverVars = d.Frames[varRef].Vars
+			valid = true
+		}
+		format = h.valueFormat(request.Arguments.Format)
+	})
+	if !valid {
+		h.session.send(newErrorResponse(request.Seq, request.Command, errInvalidReference, fmt.Sprintf("invalid variables reference=%d", request.Arguments.VariablesReference)))
+		return
+	}
 
-	driverVars := h.Driver.Frames[varRef].Vars
-	log.Printf("driverVars: %v", driverVars)
+	h.log.Debugf("driverVars: %v", driverVars)
 	vars := make([]dap.Variable, len(driverVars))
 	for i, dv := range driverVars {
-		vars[i] = DriverVarToDAPVar(dv)
+		vars[i] = DriverVarToDAPVar(dv, format)
 	}
 	select {
 	case <-h.session.stopDebug:
@@ -400,15 +808,37 @@ func (h *MonkeyHandler) OnVariablesRequest(request *dap.VariablesRequest) {
 }
 
 func (h *MonkeyHandler) OnSetVariableRequest(request *dap.SetVariableRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "setVariableRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "setVariableRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnSetExpressionRequest(request *dap.SetExpressionRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "SetExpressionRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "SetExpressionRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnSourceRequest(request *dap.SourceRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "SourceRequest is not yet supported"))
+	ref := request.Arguments.SourceReference
+	if source := request.Arguments.Source; source != nil && source.SourceReference != 0 {
+		ref = source.SourceReference
+	}
+
+	// Listings are decompiled from the VM of the runner.
+	var content string
+	var ok bool
+	h.runner.Query(func(d *driver.Driver) {
+		content, ok = h.sources.content(ref)
+	})
+	if !ok {
+		h.session.send(newErrorResponse(request.Seq, request.Command, errInvalidReference, fmt.Sprintf("unknown source reference=%d", ref)))
+		return
+	}
+
+	response := &dap.SourceResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body = dap.SourceResponseBody{
+		Content:  content,
+		MimeType: "text/x-monkey",
+	}
+	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnThreadsRequest(request *dap.ThreadsRequest) {
@@ -420,123 +850,327 @@ func (h *MonkeyHandler) OnThreadsRequest(request *dap.ThreadsRequest) {
 }
 
 func (h *MonkeyHandler) OnTerminateThreadsRequest(request *dap.TerminateThreadsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "TerminateRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "TerminateRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnEvaluateRequest(request *dap.EvaluateRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "EvaluateRequest is not yet supported"))
+	args := request.Arguments
+
+	var result object.Object
+	var err error
+	var format driver.ValueFormat
+	h.runner.Do(func(d *driver.Driver) {
+		format = h.valueFormat(args.Format)
+		err, _ = h.track(d, request.Seq, "Evaluating "+args.Expression, func() error {
+			var err error
+			result, err = d.Evaluate(args.Expression, args.FrameId)
+			return err
+		})
+	})
+	if err == driver.ErrCancelled {
+		er := newErrorResponse(request.Seq, request.Command, errCancelled, "evaluation of '{expression}' was cancelled")
+		er.Body.Error.Variables = map[string]string{"expression": args.Expression}
+		h.session.send(er)
+		return
+	}
+	if err != nil {
+		h.session.send(newErrorResponse(request.Seq, request.Command, errEvaluationFailed, err.Error()))
+		return
+	}
+
+	v := driver.ObjectToDriverVar(result, args.Expression)
+	response := &dap.EvaluateResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body = dap.EvaluateResponseBody{
+		Result: driver.FormatValue(result, format),
+		Type:   v.Type,
+	}
+	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnStepInTargetsRequest(request *dap.StepInTargetsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "StepInTargetRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "StepInTargetRequest is not yet supported"))
 }
 
+// OnGotoTargetsRequest offers the requested line as target if the
+// function that is executing has instructions on it.
 func (h *MonkeyHandler) OnGotoTargetsRequest(request *dap.GotoTargetsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "GotoTargetRequest is not yet supported"))
+	args := request.Arguments
+	response := &dap.GotoTargetsResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body.Targets = []dap.GotoTarget{}
+	h.runner.Query(func(d *driver.Driver) {
+		if !d.CanGoto(args.Source.Path, args.Line) {
+			return
+		}
+		h.gotoTargets = append(h.gotoTargets, driver.Location{Source: args.Source.Path, Line: args.Line})
+		response.Body.Targets = append(response.Body.Targets, dap.GotoTarget{
+			Id:    len(h.gotoTargets),
+			Label: fmt.Sprintf("line %d", args.Line),
+			Line:  args.Line,
+		})
+	})
+	h.session.send(response)
 }
 
+// OnCompletionsRequest completes the names of the selected frame and the
+// builtins in the Debug Console.
 func (h *MonkeyHandler) OnCompletionsRequest(request *dap.CompletionsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "CompletionRequest is not yet supported"))
+	args := request.Arguments
+	base := 0
+	if h.columnsStartAt1 {
+		base = 1
+	}
+	cursor := columnOffset(args.Text, args.Column-base)
+	var start int
+	var completions []driver.Completion
+	h.runner.Query(func(d *driver.Driver) {
+		start, completions = d.Completions(args.FrameId, args.Text, cursor)
+	})
+
+	response := &dap.CompletionsResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body.Targets = make([]dap.CompletionItem, len(completions))
+	for i, c := range completions {
+		response.Body.Targets[i] = dap.CompletionItem{
+			Label:  c.Label,
+			Type:   dap.CompletionItemType(c.Kind),
+			Detail: c.Detail,
+			Start:  utf16Len(args.Text[:start]) + base,
+			Length: utf16Len(args.Text[start:cursor]),
+		}
+	}
+	h.session.send(response)
+}
+
+// columnOffset returns the byte offset of the 0-based column of text.
+// Columns count UTF-16 code units.
+func columnOffset(text string, column int) int {
+	units := 0
+	for i, r := range text {
+		if units >= column {
+			return i
+		}
+		units += utf16Len(string(r))
+	}
+	return len(text)
+}
+
+// utf16Len returns the number of UTF-16 code units of s.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n++
+		if r >= 0x10000 {
+			n++
+		}
+	}
+	return n
 }
 
 func (h *MonkeyHandler) OnExceptionInfoRequest(request *dap.ExceptionInfoRequest) {
+	var errors []exception.Exception
+	h.runner.Query(func(d *driver.Driver) {
+		errors = d.Errors
+	})
+	if len(errors) == 0 {
+		h.session.send(newErrorResponse(request.Seq, request.Command, errNotStopped, "the program did not stop on an exception"))
+		return
+	}
 	response := &dap.ExceptionInfoResponse{}
 	response.Response = *newResponse(request.Seq, request.Command)
 	body := dap.ExceptionInfoResponseBody{}
 	body.BreakMode = "always"
-	body.Description = h.Driver.Errors[0].Error()
+	body.Description = errors[0].Error()
 	body.Details = &dap.ExceptionDetails{
-		Message: h.Driver.Errors[0].Error(),
+		Message: errors[0].Error(),
 	}
 	response.Body = body
 	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnLoadedSourcesRequest(request *dap.LoadedSourcesRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "LoadedRequest is not yet supported"))
+	response := &dap.LoadedSourcesResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.runner.Query(func(d *driver.Driver) {
+		response.Body.Sources = h.loadedSources(d)
+	})
+	h.session.send(response)
 }
 
+// OnDataBreakpointInfoRequest offers data breakpoints on the variables of
+// the scopes, see OnScopesRequest. The variables reference of a scope is
+// the id of its frame plus one.
 func (h *MonkeyHandler) OnDataBreakpointInfoRequest(request *dap.DataBreakpointInfoRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "DataBreakpointInfoRequest is not yet supported"))
+	args := request.Arguments
+	response := &dap.DataBreakpointInfoResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body.Description = fmt.Sprintf("%s cannot be watched", args.Name)
+	if args.VariablesReference > 0 {
+		h.runner.Query(func(d *driver.Driver) {
+			dataId, description, ok := d.DataBreakpointInfo(args.VariablesReference-1, args.Name)
+			if !ok {
+				return
+			}
+			response.Body.DataId = dataId
+			response.Body.Description = description
+			response.Body.AccessTypes = []dap.DataBreakpointAccessType{"write"}
+			response.Body.CanPersist = strings.HasPrefix(dataId, "global:")
+		})
+	}
+	h.session.send(response)
 }
 
+// OnSetDataBreakpointsRequest replaces the data breakpoints. A data
+// breakpoint with the condition "changed" only stops the program when the
+// value of its variable changes.
 func (h *MonkeyHandler) OnSetDataBreakpointsRequest(request *dap.SetDataBreakpointsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "SetDataBreakpointsRequest is not yet supported"))
+	bps := make([]driver.DataBreakpoint, len(request.Arguments.Breakpoints))
+	for i, bp := range request.Arguments.Breakpoints {
+		bps[i] = driver.DataBreakpoint{DataId: bp.DataId, Condition: bp.Condition}
+	}
+	var set []driver.Breakpoint
+	h.runner.Query(func(d *driver.Driver) {
+		set = d.SetDataBreakpoints(bps)
+	})
+
+	response := &dap.SetDataBreakpointsResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	response.Body.Breakpoints = make([]dap.Breakpoint, len(set))
+	for i, bp := range set {
+		response.Body.Breakpoints[i] = toBreakpoint(bp)
+	}
+	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnReadMemoryRequest(request *dap.ReadMemoryRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "ReadMemoryRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "ReadMemoryRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnDisassembleRequest(request *dap.DisassembleRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "DisassembleRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "DisassembleRequest is not yet supported"))
 }
 
 func (h *MonkeyHandler) OnCancelRequest(request *dap.CancelRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "CancelRequest is not yet supported"))
+	h.cancelRequest(request.Arguments)
+
+	response := &dap.CancelResponse{}
+	response.Response = *newResponse(request.Seq, request.Command)
+	h.session.send(response)
 }
 
 func (h *MonkeyHandler) OnBreakpointLocationsRequest(request *dap.BreakpointLocationsRequest) {
-	h.session.send(newErrorResponse(request.Seq, request.Command, "BreakpointLocationsRequest is not yet supported"))
+	h.session.send(newErrorResponse(request.Seq, request.Command, errUnsupported, "BreakpointLocationsRequest is not yet supported"))
+}
+
+// valueFormat returns the driver format for the format options of a
+// request, which may be nil. It is called on the runner.
+func (h *MonkeyHandler) valueFormat(format *dap.ValueFormat) driver.ValueFormat {
+	f := driver.ValueFormat{MaxLength: h.launchArgs.MaxValueLength}
+	if format != nil {
+		f.Hex = format.Hex
+	}
+	return f
+}
+
+// mainLocalsReference is the variables reference of the Local scope of
+// main. Frames are referenced by their id plus one, and a program never
+// has more than vm.MaxFrames of them.
+const mainLocalsReference = vm.MaxFrames + 1
+
+// isVirtual reports whether driverVar is shown by the debugger rather than
+// bound by the program.
+func isVirtual(driverVar driver.DriverVar) bool {
+	return driverVar.Name == driver.ReturnValueName || strings.HasPrefix(driverVar.Name, driver.OperandPrefix)
+}
+
+// splitMainVars splits the variables of main into the virtual ones, which
+// are shown in its Local scope, and the globals.
+func splitMainVars(vars []driver.DriverVar) (local []driver.DriverVar, global []driver.DriverVar) {
+	for _, v := range vars {
+		if isVirtual(v) {
+			local = append(local, v)
+		} else {
+			global = append(global, v)
+		}
+	}
+	return local, global
 }
 
-func DriverVarToDAPVar(driverVar driver.DriverVar) dap.Variable {
-	return dap.Variable{
+func DriverVarToDAPVar(driverVar driver.DriverVar, format driver.ValueFormat) dap.Variable {
+	v := dap.Variable{
 		Name:               driverVar.Name,
-		Value:              driverVar.Value,
+		Value:              driver.FormatValue(driverVar.Object, format),
 		VariablesReference: driverVar.VariablesReference,
 		Type:               driverVar.Type,
 	}
+	if isVirtual(driverVar) {
+		v.PresentationHint = &dap.VariablePresentationHint{Kind: "virtual", Attributes: []string{"readOnly"}}
+	}
+	return v
 }
 
-func (h *MonkeyHandler) DriverFrameToStackFrame(driverFrame driver.DebugFrame) dap.StackFrame {
+func (h *MonkeyHandler) DriverFrameToStackFrame(d *driver.Driver, driverFrame driver.DebugFrame, format *dap.StackFrameFormat) dap.StackFrame {
+	var source dap.Source
+	switch {
+	case driverFrame.Source != "" || len(d.Files) > 0:
+		source = h.sourceFor(d, driverFrame.Source)
+	default:
+		source = h.listingSource(d, driverFrame.Function)
+	}
+	// Closures link to their decompiled instructions.
+	if driverFrame.Id > 0 && driverFrame.Function != nil {
+		source.Sources = []dap.Source{h.listingSource(d, driverFrame.Function)}
+	}
+
 	return dap.StackFrame{
 		Id:     driverFrame.Id,
-		Name:   driverFrame.Name,
-		Source: &h.session.source,
+		Name:   h.frameName(driverFrame, format),
+		Source: &source,
 		Line:   driverFrame.Line,
 		Column: driverFrame.Column,
 	}
 
 }
 
-func (h *MonkeyHandler) ProduceStopEvent(state driver.State) dap.Message {
-	// switch on the State here
-	log.Printf("producing stop event for state=%s", state.String())
-	var e dap.Message
-
-	if h.terminateOnNextStep {
-		e = &dap.TerminatedEvent{
-			Event: *newEvent("terminated"),
-		}
-		return e
+// frameName returns the name of driverFrame with the parameters and the
+// line that format asks for. Parameters are shown with their names and
+// values unless format selects what to show. It is called on the runner.
+func (h *MonkeyHandler) frameName(driverFrame driver.DebugFrame, format *dap.StackFrameFormat) string {
+	name := driverFrame.Name
+	if format == nil {
+		return name
 	}
-
-	st := h.Driver.State()
-	switch st {
-	case driver.STOPPED:
-		e = &dap.StoppedEvent{
-			Event: *newEvent("stopped"),
-			Body: dap.StoppedEventBody{
-				Reason:   "breakpoint",
-				ThreadId: 1, AllThreadsStopped: true,
-			},
+	if format.Parameters && driverFrame.Id > 0 {
+		names, types, values := format.ParameterNames, format.ParameterTypes, format.ParameterValues
+		if !names && !types && !values {
+			names, values = true, true
 		}
-	case driver.COMPILER_ERROR, driver.RUNTIME_ERROR:
-		e = &dap.StoppedEvent{
-			Event: *newEvent("stopped"),
-			Body: dap.StoppedEventBody{
-				Reason:            "exception",
-				ThreadId:          1,
-				AllThreadsStopped: true,
-				Description:       st.String(),
-			},
-		}
-		h.terminateOnNextStep = true
-	case driver.DONE:
-		e = &dap.TerminatedEvent{
-			Event: *newEvent("terminated"),
+		valueFormat := h.valueFormat(&format.ValueFormat)
+		params := make([]string, len(driverFrame.Params))
+		for i, p := range driverFrame.Params {
+			param := ""
+			if names {
+				param = p.Name
+			}
+			if types {
+				if param != "" {
+					param += ": "
+				}
+				param += p.Type
+			}
+			if values {
+				if param != "" {
+					param += " = "
+				}
+				param += driver.FormatValue(p.Object, valueFormat)
+			}
+			params[i] = param
 		}
+		name = fmt.Sprintf("%s(%s)", name, strings.Join(params, ", "))
+	}
+	if format.Line {
+		name = fmt.Sprintf("%s line %d", name, driverFrame.Line)
 	}
-	return e
+	return name
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelInfo
+	LevelDebug
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel parses the name of a level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return LevelError, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, use error, info or debug", s)
+}
+
+// Components that log messages.
+const (
+	componentSession = "session"
+	componentHandler = "handler"
+	componentDriver  = "driver"
+)
+
+// LogOptions configure the logs of a session.
+type LogOptions struct {
+	// Out receives the logs. Logs are discarded if it is nil.
+	Out   io.Writer
+	Level Level
+	// Components are the components whose messages are logged. All
+	// components are logged if it is empty.
+	Components []string
+}
+
+// ParseComponents parses a comma separated list of components.
+func ParseComponents(s string) ([]string, error) {
+	var components []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		switch c {
+		case "":
+			continue
+		case componentSession, componentHandler, componentDriver:
+			components = append(components, c)
+		default:
+			return nil, fmt.Errorf("unknown log component %q, use session, handler or driver", c)
+		}
+	}
+	return components, nil
+}
+
+// logSink filters the messages of all components of a session and writes
+// them to the log and, optionally, to the client's debug console.
+type logSink struct {
+	mu         sync.Mutex
+	out        *log.Logger
+	level      Level
+	components map[string]bool
+	// console sends a message to the client. Messages of the session
+	// component are never sent, since the session sends the messages.
+	console func(message string)
+}
+
+func newLogSink(options LogOptions) *logSink {
+	s := &logSink{}
+	if options.Out != nil {
+		s.out = log.New(options.Out, "", log.LstdFlags)
+	}
+	s.setLevel(options.Level)
+	s.setComponents(options.Components)
+	return s
+}
+
+func (s *logSink) setLevel(level Level) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.level = level
+}
+
+func (s *logSink) setComponents(components []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.components = nil
+	if len(components) > 0 {
+		s.components = make(map[string]bool)
+		for _, c := range components {
+			s.components[c] = true
+		}
+	}
+}
+
+func (s *logSink) setConsole(console func(message string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.console = console
+}
+
+func (s *logSink) logger(component string) Logger {
+	return Logger{component: component, sink: s}
+}
+
+func (s *logSink) write(component string, level Level, format string, args ...any) {
+	s.mu.Lock()
+	if level > s.level || (s.components != nil && !s.components[component]) {
+		s.mu.Unlock()
+		return
+	}
+	out, console := s.out, s.console
+	s.mu.Unlock()
+
+	message := fmt.Sprintf("[%s] %s: %s", level, component, fmt.Sprintf(format, args...))
+	if out != nil {
+		out.Print(message)
+	}
+	if console != nil && component != componentSession {
+		console(message)
+	}
+}
+
+// Logger logs the messages of a component. The zero Logger discards all
+// messages.
+type Logger struct {
+	component string
+	sink      *logSink
+}
+
+func (l Logger) logf(level Level, format string, args ...any) {
+	if l.sink == nil {
+		return
+	}
+	l.sink.write(l.component, level, format, args...)
+}
+
+func (l Logger) Errorf(format string, args ...any) {
+	l.logf(LevelError, format, args...)
+}
+
+func (l Logger) Infof(format string, args ...any) {
+	l.logf(LevelInfo, format, args...)
+}
+
+func (l Logger) Debugf(format string, args ...any) {
+	l.logf(LevelDebug, format, args...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type logTestCase struct {
+	level      Level
+	components []string
+	expected   []string
+}
+
+func TestLogSink(t *testing.T) {
+	tests := []logTestCase{
+		{
+			level:    LevelInfo,
+			expected: []string{"[error] session: e", "[info] session: i", "[error] handler: e", "[info] handler: i", "[error] driver: e", "[info] driver: i"},
+		},
+		{
+			level:    LevelError,
+			expected: []string{"[error] session: e", "[error] handler: e", "[error] driver: e"},
+		},
+		{
+			level:      LevelDebug,
+			components: []string{componentDriver},
+			expected:   []string{"[error] driver: e", "[info] driver: i", "[debug] driver: d"},
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		var console []string
+		sink := newLogSink(LogOptions{Out: &out, Level: tt.level, Components: tt.components})
+		sink.setConsole(func(message string) {
+			console = append(console, message)
+		})
+		for _, component := range []string{componentSession, componentHandler, componentDriver} {
+			l := sink.logger(component)
+			l.Errorf("e")
+			l.Infof("i")
+			l.Debugf("d")
+		}
+
+		var logged []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if i := strings.Index(line, "["); i >= 0 {
+				logged = append(logged, line[i:])
+			}
+		}
+		if strings.Join(logged, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("expected logs=%q, got=%q", tt.expected, logged)
+		}
+
+		// Messages of the session are never sent to the console.
+		var expectedConsole []string
+		for _, message := range tt.expected {
+			if !strings.Contains(message, componentSession+":") {
+				expectedConsole = append(expectedConsole, message)
+			}
+		}
+		if strings.Join(console, "\n") != strings.Join(expectedConsole, "\n") {
+			t.Errorf("expected console=%q, got=%q", expectedConsole, console)
+		}
+	}
+}
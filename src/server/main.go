@@ -2,18 +2,76 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 )
 
+var (
+	record        = flag.String("record", os.Getenv("MONKEYLANG_DEBUG_RECORD"), "record the DAP messages of the session to this JSONL file")
+	logFile       = flag.String("log", os.Getenv("MONKEYLANG_DEBUG_LOG"), "append logs to this file instead of stderr")
+	logLevel      = flag.String("log-level", "info", "log level: error, info or debug")
+	logComponents = flag.String("log-components", "", "comma separated components to log: session, handler, driver (default all)")
+)
+
 func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == "repl" {
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "usage: monkeylang-debug repl <file.mky>")
+			os.Exit(2)
+		}
+		os.Exit(runRepl(flag.Arg(1), os.Stdin, os.Stdout))
+	}
+	if flag.Arg(0) == "script" {
+		if flag.NArg() != 3 {
+			fmt.Fprintln(os.Stderr, "usage: monkeylang-debug script <file.mky> <commands>")
+			os.Exit(2)
+		}
+		os.Exit(runScript(flag.Arg(1), flag.Arg(2), os.Stdout))
+	}
+	if flag.Arg(0) == "replay" {
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "usage: monkeylang-debug replay <recording.jsonl>")
+			os.Exit(2)
+		}
+		os.Exit(runReplay(flag.Arg(1), os.Stdout))
+	}
 
-	logFile, err := os.OpenFile("/tmp/debugserver.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	var options SessionOptions
+	level, err := ParseLevel(*logLevel)
 	if err != nil {
-		panic("could not open log file")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	components, err := ParseComponents(*logComponents)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	options.Log = LogOptions{Out: os.Stderr, Level: level, Components: components}
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open log file=%s, logging to stderr: %s\n", *logFile, err)
+		} else {
+			defer f.Close()
+			options.Log.Out = f
+		}
+	}
+	// The standard logger is only used for fatal errors of the session.
+	log.SetOutput(options.Log.Out)
+
+	if *record != "" {
+		recording, err := os.OpenFile(*record, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open recording file=%s: %s\n", *record, err)
+		} else {
+			defer recording.Close()
+			options.Recording = recording
+		}
 	}
-	log.SetOutput(logFile)
-	flag.Parse()
 	stream := StdioReadWriteCloser{}
-	StartSession(stream)
+	StartSession(stream, options)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"monkeylang-debug/driver"
+
+	"github.com/google/go-dap"
+)
+
+// configureProfile profiles the program if the launch configuration asks
+// for a profile. It is called on the runner.
+func (h *MonkeyHandler) configureProfile(d *driver.Driver) {
+	d.Profile = nil
+	if h.launchArgs.Profile != "" {
+		d.Profile = driver.NewProfile()
+	}
+}
+
+// writeProfile writes the profile of the program to the file of the launch
+// configuration once the program ended or the session is over, and tells
+// the user where to find it. It is called on the runner.
+func (h *MonkeyHandler) writeProfile(d *driver.Driver) {
+	if d.Profile == nil {
+		return
+	}
+	profile := d.Profile
+	d.Profile = nil
+
+	path := h.launchArgs.Profile
+	if err := writeFile(path, profile.Write); err != nil {
+		h.log.Errorf("could not write profile: %s", err)
+		return
+	}
+	h.session.send(&dap.OutputEvent{
+		Event: *newEvent("output"),
+		Body: dap.OutputEventBody{
+			Category: "console",
+			Output:   fmt.Sprintf("Wrote profile to %s, view it with: go tool pprof %s\n", path, path),
+		},
+	})
+}
+
+// writeReports writes the profile, the coverage and the timeline that the
+// launch configuration asks for. It is called on the runner.
+func (h *MonkeyHandler) writeReports(d *driver.Driver) {
+	h.writeProfile(d)
+	h.writeCoverage(d)
+	h.writeTimeline()
+}
+
+// writeFile creates the file at path and writes it with write.
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
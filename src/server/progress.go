@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"monkeylang-debug/driver"
+
+	"github.com/google/go-dap"
+)
+
+const (
+	progressThreshold = 500 * time.Millisecond
+	progressInterval  = 250 * time.Millisecond
+	// progressCheckCycles is the number of VM cycles between two looks at
+	// the clock.
+	progressCheckCycles = 4096
+)
+
+// operation is a cancellable driver run started by a request.
+type operation struct {
+	requestSeq int
+	progressId string
+	title      string
+	started    time.Time
+	reported   bool
+	ended      bool
+	lastReport time.Time
+	cancelled  bool
+}
+
+func (o *operation) matches(args *dap.CancelArguments) bool {
+	if args == nil {
+		return false
+	}
+	if args.ProgressId != "" {
+		return args.ProgressId == o.progressId
+	}
+	return args.RequestId == o.requestSeq
+}
+
+// track runs run as a cancellable operation for the request with seq
+// requestSeq and reports its progress. The flag reports that a cancel
+// request stopped it.
+func (h *MonkeyHandler) track(d *driver.Driver, requestSeq int, title string, run func() error) (error, bool) {
+	op := &operation{
+		requestSeq: requestSeq,
+		progressId: fmt.Sprintf("run-%d", requestSeq),
+		title:      title,
+		started:    time.Now(),
+	}
+	h.opMux.Lock()
+	if h.cancelledSeqs[requestSeq] {
+		delete(h.cancelledSeqs, requestSeq)
+		h.opMux.Unlock()
+		return driver.ErrCancelled, true
+	}
+	// Cancels are only sent for the operation in progress, any other is
+	// stale.
+	d.ClearCancel()
+	h.op = op
+	h.opMux.Unlock()
+
+	d.OnCycle = func(executed int) {
+		if executed%progressCheckCycles == 0 {
+			h.reportProgress(op, executed)
+		}
+	}
+	err := run()
+	d.OnCycle = nil
+
+	h.endProgress()
+	h.opMux.Lock()
+	h.op = nil
+	d.ClearCancel()
+	h.opMux.Unlock()
+	return err, err == driver.ErrCancelled && op.cancelled
+}
+
+// cancelRequest stops the operation of a request, or the request before
+// its operation starts.
+func (h *MonkeyHandler) cancelRequest(args *dap.CancelArguments) {
+	if args == nil {
+		return
+	}
+	h.opMux.Lock()
+	defer h.opMux.Unlock()
+	if h.op != nil && h.op.matches(args) {
+		h.log.Infof("cancelling request=%d", h.op.requestSeq)
+		h.op.cancelled = true
+		h.runner.Cancel()
+		return
+	}
+	if args.RequestId > 0 {
+		h.log.Infof("cancelling request=%d before it runs", args.RequestId)
+		h.cancelledSeqs[args.RequestId] = true
+	}
+}
+
+// endProgress ends the progress notification of the current operation,
+// if one was shown.
+func (h *MonkeyHandler) endProgress() {
+	h.opMux.Lock()
+	op := h.op
+	h.opMux.Unlock()
+	if op == nil || !op.reported || op.ended {
+		return
+	}
+	op.ended = true
+	e := &dap.ProgressEndEvent{
+		Event: *newEvent("progressEnd"),
+		Body:  dap.ProgressEndEventBody{ProgressId: op.progressId},
+	}
+	h.session.send(e)
+}
+
+func (h *MonkeyHandler) reportProgress(op *operation, executed int) {
+	if !h.supportsProgress {
+		return
+	}
+	now := time.Now()
+	message := fmt.Sprintf("%d instructions executed", executed)
+	switch {
+	case !op.reported && now.Sub(op.started) >= progressThreshold:
+		op.reported = true
+		op.lastReport = now
+		e := &dap.ProgressStartEvent{
+			Event: *newEvent("progressStart"),
+			Body: dap.ProgressStartEventBody{
+				ProgressId:  op.progressId,
+				Title:       op.title,
+				RequestId:   op.requestSeq,
+				Cancellable: true,
+				Message:     message,
+			},
+		}
+		h.session.send(e)
+	case op.reported && now.Sub(op.lastReport) >= progressInterval:
+		op.lastReport = now
+		e := &dap.ProgressUpdateEvent{
+			Event: *newEvent("progressUpdate"),
+			Body: dap.ProgressUpdateEventBody{
+				ProgressId: op.progressId,
+				Message:    message,
+			},
+		}
+		h.session.send(e)
+	}
+}
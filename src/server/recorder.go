@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// recordedMessage is a line of a recording. Direction is "in" for messages
+// sent by the client and "out" for messages sent by the adapter.
+type recordedMessage struct {
+	Time      string          `json:"time,omitempty"`
+	Direction string          `json:"direction"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// recorder writes every message of a session to a JSONL file. A nil
+// recorder records nothing.
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newRecorder(w io.Writer) *recorder {
+	if w == nil {
+		return nil
+	}
+	return &recorder{enc: json.NewEncoder(w)}
+}
+
+// record writes the encoded DAP message content.
+func (r *recorder) record(direction string, content []byte) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.enc.Encode(recordedMessage{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Direction: direction,
+		Message:   content,
+	})
+}
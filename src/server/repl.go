@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"monkeylang-debug/driver"
+)
+
+const replHelp = `Commands:
+  break [file:]LINE    set a breakpoint (b)
+  delete [[file:]LINE] delete a breakpoint, or all breakpoints (d)
+  run                  run the program from the start (r)
+  continue             run until the next breakpoint (c)
+  next                 step over the current line (n)
+  step                 step into a call on the current line (s)
+  finish               run until the current function returns
+  bt                   print the call stack (backtrace)
+  frame N              select the frame with id N (f)
+  locals               print the variables of the selected frame
+  print EXPR           evaluate EXPR in the selected frame (p)
+  list                 print the program with breakpoints (#) and position (->) (l)
+  help                 print this help (h)
+  quit                 leave the debugger (q)
+An empty line repeats next, step and continue.`
+
+var (
+	errNotRunning  = errors.New("the program is not being run")
+	errNotCompiled = errors.New("the program did not compile, fix it and run it again")
+)
+
+// repl drives a Driver with gdb-style commands.
+type repl struct {
+	d   *driver.Driver
+	out io.Writer
+	// breakpoints are the breakpoint lines of each file, keyed by path.
+	breakpoints map[string][]int
+	started     bool
+	// exited is set when the program ran to completion.
+	exited bool
+	frame  int
+	// last is the last event of the driver.
+	last driver.Event
+}
+
+func newRepl(d *driver.Driver, out io.Writer) *repl {
+	r := &repl{
+		d:           d,
+		out:         out,
+		breakpoints: make(map[string][]int),
+	}
+	d.Subscribe(func(e driver.Event) {
+		r.last = e
+	})
+	return r
+}
+
+// openProgram loads the program at path. Errors that keep the program
+// from starting are printed to out.
+func openProgram(path string, out io.Writer) (*repl, bool) {
+	d := driver.New()
+	err := d.Load(path)
+	if err != nil && !d.HasErrors() {
+		fmt.Fprintf(out, "could not read source file=%s: %s\n", path, err)
+		return nil, false
+	}
+	r := newRepl(d, out)
+	if d.VM == nil {
+		r.printErrors()
+		return nil, false
+	}
+	return r, true
+}
+
+// runRepl loads the program at path and reads commands from in until quit
+// or the end of the input. It returns the exit code of the debugger.
+func runRepl(path string, in io.Reader, out io.Writer) int {
+	r, ok := openProgram(path, out)
+	if !ok {
+		return 1
+	}
+
+	// Ctrl-C interrupts a long run instead of killing the debugger.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			r.d.Cancel()
+		}
+	}()
+
+	scanner := bufio.NewScanner(in)
+	last := ""
+	for {
+		fmt.Fprint(out, "(mdb) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return 0
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			line = last
+		}
+		if line == "" {
+			continue
+		}
+		last = ""
+		switch strings.Fields(line)[0] {
+		case "next", "n", "step", "s", "continue", "c":
+			last = line
+		case "quit", "q":
+			return 0
+		}
+
+		if err := r.execute(line); err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+	}
+}
+
+// execute runs a single command.
+func (r *repl) execute(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	command, args := fields[0], fields[1:]
+	switch command {
+	case "break", "b":
+		return r.setBreakpoint(args)
+	case "delete", "d":
+		return r.deleteBreakpoint(args)
+	case "run", "r":
+		return r.run()
+	case "continue", "c":
+		return r.step(r.cont)
+	case "next", "n":
+		return r.step(r.d.StepOver)
+	case "step", "s":
+		return r.step(r.d.StepInto)
+	case "finish":
+		return r.step(r.d.StepOut)
+	case "bt", "backtrace", "where":
+		return r.backtrace()
+	case "frame", "f":
+		return r.selectFrame(args)
+	case "locals":
+		return r.locals()
+	case "print", "p":
+		expression := strings.TrimSpace(strings.TrimPrefix(line, command))
+		return r.print(expression)
+	case "list", "l":
+		return r.list()
+	case "help", "h":
+		fmt.Fprintln(r.out, replHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, try help", command)
+}
+
+// parseLocation parses [file:]LINE. Files are relative to the directory
+// of the program, like imports.
+func (r *repl) parseLocation(args []string) (string, int, error) {
+	if len(args) != 1 {
+		return "", 0, errors.New("expected [file:]LINE")
+	}
+	source := r.d.Source
+	spec := args[0]
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		source = spec[:i]
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(filepath.Dir(r.d.Source), source)
+		}
+		source = filepath.Clean(source)
+		spec = spec[i+1:]
+	}
+	line, err := strconv.Atoi(spec)
+	if err != nil || line < 1 {
+		return "", 0, fmt.Errorf("invalid line %q", spec)
+	}
+	return source, line, nil
+}
+
+func (r *repl) setBreakpoint(args []string) error {
+	source, line, err := r.parseLocation(args)
+	if err != nil {
+		return err
+	}
+	lines := r.breakpoints[source]
+	for _, l := range lines {
+		if l == line {
+			return nil
+		}
+	}
+	lines = append(lines, line)
+	sort.Ints(lines)
+	r.breakpoints[source] = lines
+	r.d.SetBreakPointsInSource(source, lines)
+	fmt.Fprintf(r.out, "Breakpoint at %s:%d\n", source, line)
+	return nil
+}
+
+func (r *repl) deleteBreakpoint(args []string) error {
+	if len(args) == 0 {
+		for source := range r.breakpoints {
+			r.d.SetBreakPointsInSource(source, nil)
+		}
+		r.breakpoints = make(map[string][]int)
+		return nil
+	}
+	source, line, err := r.parseLocation(args)
+	if err != nil {
+		return err
+	}
+	lines := r.breakpoints[source]
+	for i, l := range lines {
+		if l == line {
+			lines = append(lines[:i], lines[i+1:]...)
+			r.breakpoints[source] = lines
+			r.d.SetBreakPointsInSource(source, lines)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint at %s:%d", source, line)
+}
+
+// run starts the program, or starts it over if it has already been run.
+// The program is read again, so that edits are picked up.
+func (r *repl) run() error {
+	r.exited = false
+	if r.d.State() != driver.NOT_STARTED {
+		err := r.d.Restart()
+		if err != nil && !r.d.HasErrors() {
+			return err
+		}
+		if r.d.VM == nil {
+			r.started = false
+			r.printErrors()
+			return nil
+		}
+	}
+	r.started = true
+	return r.step(r.cont)
+}
+
+func (r *repl) cont() (error, bool) {
+	return r.d.Continue()
+}
+
+// step runs the program with advance and reports where it stopped.
+func (r *repl) step(advance func() (error, bool)) error {
+	if !r.started {
+		return errNotRunning
+	}
+	switch r.d.State() {
+	case driver.NOT_STARTED, driver.PAUSED:
+	case driver.RUNTIME_ERROR:
+		// A failed program can be inspected, but not run any further.
+		err, _ := advance()
+		return err
+	default:
+		return errNotRunning
+	}
+	r.frame = 0
+	r.last = nil
+	// Ctrl-C pressed at the prompt does not interrupt the next run.
+	r.d.ClearCancel()
+	advance()
+	switch e := r.last.(type) {
+	case driver.Paused:
+		fmt.Fprintln(r.out, "Interrupted.")
+	case driver.Errored:
+		r.frame = r.topFrame().Id
+		return fmt.Errorf("runtime error at %s:%d: %s", e.Location.Source, e.Location.Line, e.Err)
+	case driver.Exited:
+		r.started = false
+		r.exited = true
+		fmt.Fprintln(r.out, "Program exited.")
+		return nil
+	case driver.StoppedOnBreakpoint:
+		fmt.Fprint(r.out, "Breakpoint, ")
+	}
+	r.printLocation()
+	return nil
+}
+
+// list prints the program with its breakpoints and the line it is
+// paused at. A program that did not compile has no VM to locate.
+func (r *repl) list() error {
+	if r.d.State() == driver.COMPILER_ERROR {
+		return errNotCompiled
+	}
+	fmt.Fprintln(r.out, strings.TrimPrefix(r.d.BreakpoinState(), "\n"))
+	return nil
+}
+
+// printErrors prints the errors that kept the program from compiling.
+func (r *repl) printErrors() {
+	for _, e := range r.d.Errors {
+		loc := r.d.FileLocation(e.Line())
+		fmt.Fprintf(r.out, "%s:%d: %s\n", loc.Source, loc.Line, e)
+	}
+}
+
+// printLocation prints the function, file and line the program stopped at.
+func (r *repl) printLocation() {
+	top := r.topFrame()
+	r.frame = top.Id
+	fmt.Fprintf(r.out, "%s at %s:%d\n", top.Name, top.Source, top.Line)
+	fmt.Fprintf(r.out, "%d\t%s\n", top.Line, r.sourceLine(top.Source, top.Line))
+}
+
+// topFrame returns the frame of the function that is executing.
+func (r *repl) topFrame() driver.DebugFrame {
+	frames := r.d.CollectFrames()
+	return frames[len(frames)-1]
+}
+
+func (r *repl) sourceLine(source string, line int) string {
+	for _, f := range r.d.Files {
+		if f.Path != source {
+			continue
+		}
+		lines := strings.Split(f.Code, "\n")
+		if line >= 1 && line <= len(lines) {
+			return lines[line-1]
+		}
+	}
+	return ""
+}
+
+func (r *repl) backtrace() error {
+	if !r.started {
+		return errNotRunning
+	}
+	frames := r.d.CollectFrames()
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		marker := " "
+		if f.Id == r.frame {
+			marker = "*"
+		}
+		fmt.Fprintf(r.out, "%s#%d %s at %s:%d\n", marker, f.Id, f.Name, f.Source, f.Line)
+	}
+	return nil
+}
+
+func (r *repl) selectFrame(args []string) error {
+	if !r.started {
+		return errNotRunning
+	}
+	if len(args) != 1 {
+		return errors.New("expected a frame id")
+	}
+	id, err := strconv.Atoi(args[0])
+	frames := r.d.CollectFrames()
+	if err != nil || id < 0 || id >= len(frames) {
+		return fmt.Errorf("invalid frame id %q", args[0])
+	}
+	r.frame = id
+	f := frames[id]
+	fmt.Fprintf(r.out, "#%d %s at %s:%d\n", f.Id, f.Name, f.Source, f.Line)
+	return nil
+}
+
+func (r *repl) locals() error {
+	if !r.started {
+		return errNotRunning
+	}
+	frames := r.d.CollectFrames()
+	for _, v := range frames[r.frame].Vars {
+		fmt.Fprintf(r.out, "%s = %s\n", v.Name, v.Value)
+	}
+	return nil
+}
+
+func (r *repl) print(expression string) error {
+	if expression == "" {
+		return errors.New("expected an expression")
+	}
+	if !r.started {
+		return errNotRunning
+	}
+	result, err := r.d.Evaluate(expression, r.frame)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(r.out, result.Inspect())
+	return nil
+}
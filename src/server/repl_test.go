@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"monkeylang-debug/driver"
+)
+
+type replTestCase struct {
+	name         string
+	program      string
+	input        string
+	expectedCode int
+	expectedOut  []string
+}
+
+func TestRepl(t *testing.T) {
+	tests := []replTestCase{
+		{
+			name:  "break and inspect",
+			input: "break 6\nrun\nbt\nlocals\nprint arr.first() * 10\nframe 1\nlocals\n",
+			expectedOut: []string{
+				"Breakpoint at testdata/scripts/arr_any.mky:6",
+				"Breakpoint, iter at testdata/scripts/arr_any.mky:6\n6\t        if (pred(arr.first())) {",
+				"*#2 iter at testdata/scripts/arr_any.mky:6\n #1 arr_any at testdata/scripts/arr_any.mky:12\n #0 main at testdata/scripts/arr_any.mky:15",
+				"arr = [1, 3, 4]",
+				"(mdb) 10\n",
+				"#1 arr_any at testdata/scripts/arr_any.mky:12",
+				"list = [1, 3, 4]\npred = function",
+			},
+		},
+		{
+			name:  "empty line repeats step",
+			input: "break 6\nrun\nnext\n\nfinish\n",
+			expectedOut: []string{
+				"iter at testdata/scripts/arr_any.mky:9",
+				"arr_any at testdata/scripts/arr_any.mky:12",
+				"main at testdata/scripts/arr_any.mky:15",
+			},
+		},
+		{
+			name:  "run to the end",
+			input: "break 6\nrun\ndelete\ncontinue\nbt\nnext\n",
+			expectedOut: []string{
+				"Program exited.\n(mdb) the program is not being run\n(mdb) the program is not being run",
+			},
+		},
+		{
+			name:  "list breakpoints",
+			input: "break 12\nlist\n",
+			expectedOut: []string{
+				"->  let arr_any = fn(list, pred) {",
+				"#       iter(list);",
+			},
+		},
+		{
+			name:  "not running",
+			input: "bt\nlocals\nprint 1\nstep\n",
+			expectedOut: []string{
+				strings.Repeat("(mdb) the program is not being run\n", 4),
+			},
+		},
+		{
+			name:  "invalid commands",
+			input: "foo\nbreak x\nframe 1\nprint\nquit\nbt\n",
+			expectedOut: []string{
+				"unknown command \"foo\", try help",
+				"invalid line \"x\"",
+				"expected an expression",
+			},
+		},
+		{
+			name:    "inspect a failed program",
+			program: "testdata/scripts/call_value.mky",
+			input:   "run\nbt\nlocals\nprint x\nnext\ncontinue\n",
+			expectedOut: []string{
+				"runtime error at testdata/scripts/call_value.mky:3: Runtime error. calling non-function and non-built-in",
+				"*#1 f at testdata/scripts/call_value.mky:3\n #0 main at testdata/scripts/call_value.mky:5",
+				"(operand) y = 2\nx = 1\ny = 2",
+				"(mdb) 1\n",
+				strings.Repeat("(mdb) program has failed: Runtime error. calling non-function and non-built-in: Line: 3, Col: 2\n", 2),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := tt.program
+			if program == "" {
+				program = "testdata/scripts/arr_any.mky"
+			}
+			var out bytes.Buffer
+			code := runRepl(program, strings.NewReader(tt.input), &out)
+			if code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got=%d\n%s", tt.expectedCode, code, out.String())
+			}
+			for _, expected := range tt.expectedOut {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expected output to contain %q, got=\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestReplRunCompileError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "program.mky")
+	err := os.WriteFile(path, []byte("let a = 1;\nlet b = a + 1;\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := driver.New()
+	if err := d.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	r := newRepl(d, &out)
+	for _, command := range []string{"break 2", "run"} {
+		if err := r.execute(command); err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+	}
+
+	// The program is run again after it was edited into one that does not
+	// compile.
+	err = os.WriteFile(path, []byte("let a = 1;\nlet b = c + 1;\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.execute("run"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if !strings.Contains(out.String(), "undefined variable c") {
+		t.Errorf("expected the compile error to be printed, got=\n%s", out.String())
+	}
+
+	tests := []struct {
+		command  string
+		expected error
+	}{
+		{"list", errNotCompiled},
+		{"bt", errNotRunning},
+		{"locals", errNotRunning},
+		{"print a", errNotRunning},
+		{"next", errNotRunning},
+		{"continue", errNotRunning},
+	}
+	for _, tt := range tests {
+		if err := r.execute(tt.command); err != tt.expected {
+			t.Errorf("%s: expected error %q, got=%v", tt.command, tt.expected, err)
+		}
+	}
+}
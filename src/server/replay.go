@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-dap"
+)
+
+// replayTimeout is how long the replay waits for the response to a
+// request and the events that followed it in the recording.
+const replayTimeout = 5 * time.Second
+
+// pipeConn connects a session to the pipes of a replayClient.
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (c pipeConn) Close() error {
+	c.PipeReader.Close()
+	return c.PipeWriter.Close()
+}
+
+// replayClient drives an in-process session like an editor would and
+// keeps a transcript of the messages that were exchanged. Messages in the
+// transcript are normalized.
+type replayClient struct {
+	requests   *io.PipeWriter
+	messages   chan []byte
+	done       chan struct{}
+	transcript []recordedMessage
+	// received counts the messages of the adapter by messageKey.
+	received map[string]int
+}
+
+func newReplayClient() *replayClient {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &replayClient{
+		requests: inW,
+		messages: make(chan []byte, 100),
+		done:     make(chan struct{}),
+		received: make(map[string]int),
+	}
+
+	go func() {
+		StartSession(pipeConn{inR, outW}, SessionOptions{})
+		close(c.done)
+	}()
+	go func() {
+		r := bufio.NewReader(outR)
+		for {
+			content, err := dap.ReadBaseMessage(r)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			c.messages <- content
+		}
+	}()
+	return c
+}
+
+func (c *replayClient) record(direction string, content []byte) (map[string]any, error) {
+	var message map[string]any
+	err := json.Unmarshal(content, &message)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode message=%s: %w", content, err)
+	}
+	normalized, err := json.Marshal(normalize(message))
+	if err != nil {
+		return nil, err
+	}
+	c.transcript = append(c.transcript, recordedMessage{Direction: direction, Message: normalized})
+	return message, nil
+}
+
+// normalize removes the parts of a message that differ between runs.
+// Requests keep their sequence numbers, since responses refer to them.
+func normalize(message map[string]any) map[string]any {
+	if _, ok := message["seq"]; ok && message["type"] != "request" {
+		message["seq"] = 0
+	}
+	return message
+}
+
+// messageKey identifies the responses to a request and the events of
+// the same kind.
+func messageKey(message map[string]any) string {
+	switch message["type"] {
+	case "response":
+		return fmt.Sprintf("response to %v", message["request_seq"])
+	case "event":
+		return fmt.Sprintf("event %v", message["event"])
+	}
+	return fmt.Sprintf("%v", message["type"])
+}
+
+// send sends the request in content.
+func (c *replayClient) send(content []byte) error {
+	_, err := c.record(directionIn, content)
+	if err != nil {
+		return err
+	}
+	err = dap.WriteBaseMessage(c.requests, content)
+	if err != nil {
+		return fmt.Errorf("could not send request=%s: %w", content, err)
+	}
+	return nil
+}
+
+// counts returns a copy of the number of messages received so far.
+func (c *replayClient) counts() map[string]int {
+	counts := make(map[string]int, len(c.received))
+	for k, n := range c.received {
+		counts[k] = n
+	}
+	return counts
+}
+
+// await receives messages until at least as many messages of each key in
+// target have been received.
+func (c *replayClient) await(target map[string]int) error {
+	missing := func() []string {
+		var keys []string
+		for k, n := range target {
+			if c.received[k] < n {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	timeout := time.After(replayTimeout)
+	for len(missing()) > 0 {
+		select {
+		case content, ok := <-c.messages:
+			if !ok {
+				return fmt.Errorf("session ended while waiting for %s", strings.Join(missing(), ", "))
+			}
+			message, err := c.record(directionOut, content)
+			if err != nil {
+				return err
+			}
+			c.received[messageKey(message)]++
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for %s", strings.Join(missing(), ", "))
+		}
+	}
+	return nil
+}
+
+// close ends the session and records the messages that are still sent.
+func (c *replayClient) close() error {
+	c.requests.Close()
+	timeout := time.After(replayTimeout)
+	for {
+		select {
+		case content, ok := <-c.messages:
+			if !ok {
+				<-c.done
+				return nil
+			}
+			_, err := c.record(directionOut, content)
+			if err != nil {
+				return err
+			}
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for the session to end")
+		}
+	}
+}
+
+// readRecording reads the messages of a recording made with -record.
+func readRecording(path string) ([]recordedMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recording []recordedMessage
+	dec := json.NewDecoder(f)
+	for {
+		var m recordedMessage
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			return recording, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read recording=%s: %w", path, err)
+		}
+		recording = append(recording, m)
+	}
+}
+
+// runReplay sends the client messages of the recording at path to a new
+// session and prints how the messages of the adapter differ from the
+// recorded ones. It returns a non-zero exit code if they differ.
+func runReplay(path string, out io.Writer) int {
+	recording, err := readRecording(path)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	expected := make([]recordedMessage, 0, len(recording))
+	for _, m := range recording {
+		var message map[string]any
+		err := json.Unmarshal(m.Message, &message)
+		if err != nil {
+			fmt.Fprintf(out, "could not decode recorded message=%s: %s\n", m.Message, err)
+			return 1
+		}
+		normalized, _ := json.Marshal(normalize(message))
+		expected = append(expected, recordedMessage{Direction: m.Direction, Message: normalized})
+	}
+
+	// Before each request of the client, wait until the adapter sent as
+	// many messages as it had sent at that point of the recording.
+	c := newReplayClient()
+	failed := false
+	target := make(map[string]int)
+	for i, m := range recording {
+		if m.Direction == directionOut {
+			var message map[string]any
+			json.Unmarshal(m.Message, &message)
+			target[messageKey(message)]++
+			continue
+		}
+		if err := c.await(target); err != nil {
+			fmt.Fprintf(out, "before message %d: %s\n", i+1, err)
+			failed = true
+		}
+		if err := c.send(m.Message); err != nil {
+			fmt.Fprintln(out, err)
+			failed = true
+		}
+	}
+	if err := c.await(target); err != nil {
+		fmt.Fprintf(out, "at the end of the recording: %s\n", err)
+		failed = true
+	}
+	if err := c.close(); err != nil {
+		fmt.Fprintln(out, err)
+		failed = true
+	}
+
+	// The client side is the same by construction and is interleaved
+	// differently with the adapter's messages, so only the messages of
+	// the adapter are compared. Requests are handled concurrently, so
+	// only the order of messages of the same kind is significant.
+	diff := diffTranscripts(outgoing(expected), outgoing(c.transcript))
+	for _, line := range diff {
+		fmt.Fprintln(out, line)
+	}
+	if failed || len(diff) > 0 {
+		return 1
+	}
+	fmt.Fprintf(out, "replayed %d messages, no differences\n", len(recording))
+	return 0
+}
+
+// outgoing returns the messages of the adapter in transcript, grouped by
+// messageKey.
+func outgoing(transcript []recordedMessage) []recordedMessage {
+	var messages []recordedMessage
+	var keys []string
+	for _, m := range transcript {
+		if m.Direction != directionOut {
+			continue
+		}
+		var message map[string]any
+		json.Unmarshal(m.Message, &message)
+		messages = append(messages, m)
+		keys = append(keys, messageKey(message))
+	}
+
+	order := make([]int, len(messages))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return keys[order[a]] < keys[order[b]]
+	})
+	grouped := make([]recordedMessage, len(messages))
+	for i, j := range order {
+		grouped[i] = messages[j]
+	}
+	return grouped
+}
+
+// diffTranscripts returns the messages that are only in expected, prefixed
+// with -, and those only in got, prefixed with +.
+func diffTranscripts(expected []recordedMessage, got []recordedMessage) []string {
+	line := func(m recordedMessage) string {
+		return m.Direction + " " + string(m.Message)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// expected[i:] and got[j:].
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if line(expected[i]) == line(got[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(expected) || j < len(got) {
+		switch {
+		case i < len(expected) && j < len(got) && line(expected[i]) == line(got[j]):
+			i++
+			j++
+		case j == len(got) || (i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+line(expected[i]))
+			i++
+		default:
+			diff = append(diff, "+ "+line(got[j]))
+			j++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A script is a file of debugger commands that is run without user
+// interaction. Besides the commands of the repl, scripts can check the
+// state of the program:
+//
+//	expect line [file:]LINE  the program is stopped at LINE
+//	expect exited            the program has run to completion
+//	assert EXPR == EXPR      both expressions have the same value in the
+//	                         selected frame
+//
+// Empty lines and lines starting with # are skipped. The script stops at
+// the first command that fails.
+
+// runScript debugs the program at path with the commands of the script at
+// scriptPath. It returns a non-zero exit code if a command or check fails.
+func runScript(path string, scriptPath string, out io.Writer) int {
+	f, err := os.Open(scriptPath)
+	if err != nil {
+		fmt.Fprintf(out, "could not read script file=%s: %s\n", scriptPath, err)
+		return 1
+	}
+	defer f.Close()
+
+	r, ok := openProgram(path, out)
+	if !ok {
+		return 1
+	}
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fmt.Fprintf(out, "(mdb) %s\n", line)
+
+		command := strings.Fields(line)[0]
+		if command == "quit" || command == "q" {
+			break
+		}
+		err := r.check(line)
+		if err != nil {
+			fmt.Fprintf(out, "%s:%d: %s\n", scriptPath, lineNum, err)
+			return 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(out, "could not read script file=%s: %s\n", scriptPath, err)
+		return 1
+	}
+	return 0
+}
+
+// check runs a command of a script.
+func (r *repl) check(line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "expect":
+		return r.expect(fields[1:])
+	case "assert":
+		return r.assert(strings.TrimSpace(strings.TrimPrefix(line, "assert")))
+	}
+	return r.execute(line)
+}
+
+func (r *repl) expect(args []string) error {
+	if len(args) == 1 && args[0] == "exited" {
+		if r.started {
+			top := r.topFrame()
+			return fmt.Errorf("expected the program to exit, but it is stopped at %s:%d", top.Source, top.Line)
+		}
+		if !r.exited {
+			return fmt.Errorf("expected the program to exit, but %s", errNotRunning)
+		}
+		return nil
+	}
+
+	if len(args) != 2 || args[0] != "line" {
+		return errors.New("expected expect line [file:]LINE or expect exited")
+	}
+	source, line, err := r.parseLocation(args[1:])
+	if err != nil {
+		return err
+	}
+	if !r.started {
+		return fmt.Errorf("expected to stop at %s:%d, but %s", source, line, errNotRunning)
+	}
+	top := r.topFrame()
+	if top.Source != source || top.Line != line {
+		return fmt.Errorf("expected to stop at %s:%d, but stopped at %s:%d", source, line, top.Source, top.Line)
+	}
+	return nil
+}
+
+// assert compares the values of the expressions on both sides of the last
+// == in assertion.
+func (r *repl) assert(assertion string) error {
+	i := strings.LastIndex(assertion, "==")
+	if i < 0 {
+		return errors.New("expected assert EXPR == EXPR")
+	}
+	left := strings.TrimSpace(assertion[:i])
+	right := strings.TrimSpace(assertion[i+2:])
+	if left == "" || right == "" {
+		return errors.New("expected assert EXPR == EXPR")
+	}
+	if !r.started {
+		return errNotRunning
+	}
+
+	got, err := r.d.Evaluate(left, r.frame)
+	if err != nil {
+		return err
+	}
+	want, err := r.d.Evaluate(right, r.frame)
+	if err != nil {
+		return err
+	}
+	if got.Type() != want.Type() || got.Inspect() != want.Inspect() {
+		return fmt.Errorf("assertion failed: %s is %s, expected %s", left, got.Inspect(), want.Inspect())
+	}
+	return nil
+}
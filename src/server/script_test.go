@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type scriptTestCase struct {
+	script       string
+	expectedCode int
+	expectedOut  string
+}
+
+func TestScript(t *testing.T) {
+	tests := []scriptTestCase{
+		{
+			script:       "testdata/scripts/arr_any.mdb",
+			expectedCode: 0,
+			expectedOut:  "Program exited.",
+		},
+		{
+			script:       "testdata/scripts/failing.mdb",
+			expectedCode: 1,
+			expectedOut:  "failing.mdb:4: assertion failed: arr is [1, 3, 4], expected [1, 2]",
+		},
+		{
+			script:       "testdata/scripts/wrong_line.mdb",
+			expectedCode: 1,
+			expectedOut:  "wrong_line.mdb:4: expected to stop at testdata/scripts/arr_any.mky:4, but stopped at testdata/scripts/arr_any.mky:9",
+		},
+		{
+			script:       "testdata/scripts/not_run.mdb",
+			expectedCode: 1,
+			expectedOut:  "not_run.mdb:2: expected the program to exit, but the program is not being run",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		code := runScript("testdata/scripts/arr_any.mky", tt.script, &out)
+		if code != tt.expectedCode {
+			t.Errorf("%s: expected exit code %d, got=%d\n%s", tt.script, tt.expectedCode, code, out.String())
+		}
+		if !strings.Contains(out.String(), tt.expectedOut) {
+			t.Errorf("%s: expected output to contain %q, got=\n%s", tt.script, tt.expectedOut, out.String())
+		}
+	}
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"runtime/debug"
 	"sync"
 
+	"monkeylang-debug/driver"
+
 	"github.com/google/go-dap"
 )
 
@@ -32,66 +36,159 @@ func (s StdioReadWriteCloser) Close() error {
 	return os.Stdout.Close()
 }
 
-func StartSession(conn io.ReadWriteCloser) {
+// SessionOptions configure a debug session.
+type SessionOptions struct {
+	// Recording receives every message of the session as JSONL, if set.
+	Recording io.Writer
+	Log       LogOptions
+}
+
+func StartSession(conn io.ReadWriteCloser, options SessionOptions) {
 	debugSession := Session{
 		rw:        bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
 		sendQueue: make(chan dap.Message),
 		stopDebug: make(chan struct{}),
-		debuglog:  true,
+		recorder:  newRecorder(options.Recording),
+		logs:      newLogSink(options.Log),
 	}
+	debugSession.log = debugSession.logs.logger(componentSession)
 	debugSession.Handler = NewHandler()
 	debugSession.Handler.SetSession(&debugSession)
+	debugSession.Handler.log = debugSession.logs.logger(componentHandler)
+	driverLog := debugSession.logs.logger(componentDriver)
+	debugSession.Handler.runner.Do(func(d *driver.Driver) {
+		d.Logf = driverLog.Debugf
+	})
 
 	go debugSession.sendFromQueue()
 
 	for {
+		// Messages that cannot be decoded are answered by handleRequest,
+		// so errors here mean that the connection is broken.
 		err := debugSession.handleRequest()
-		// TODO(polina): check for connection vs decoding error?
 		if err != nil {
 			if err == io.EOF {
-				log.Println("No more data to read:", err)
-				break
+				debugSession.log.Infof("No more data to read: %s", err)
+			} else {
+				debugSession.log.Errorf("could not read message: %s", err)
 			}
-			// There maybe more messages to process, but
-			// we will start with the strict behavior of only accepting
-			// expected inputs.
-			log.Fatal("Server error: ", err)
+			break
 		}
 	}
 
-	close(debugSession.stopDebug)
+	debugSession.stop()
 	debugSession.sendWg.Wait()
+	debugSession.Handler.runner.Close()
 	close(debugSession.sendQueue)
 	conn.Close()
 }
 
+// stop notifies long-running handlers that the session is ending.
+func (ds *Session) stop() {
+	ds.stopOnce.Do(func() {
+		close(ds.stopDebug)
+	})
+}
+
+func (ds *Session) record(direction string, content []byte) {
+	err := ds.recorder.record(direction, content)
+	if err != nil {
+		ds.log.Errorf("could not record message: %s", err)
+	}
+}
+
 func (ds *Session) send(message dap.Message) {
 	ds.sendQueue <- message
 }
 
 func (ds *Session) sendFromQueue() {
 	for message := range ds.sendQueue {
-		dap.WriteProtocolMessage(ds.rw.Writer, message)
-		log.Printf("Message sent\n\t%#v\n", message)
+		content, err := json.Marshal(message)
+		if err != nil {
+			ds.log.Errorf("could not encode message: %s", err)
+			continue
+		}
+		ds.record(directionOut, content)
+		dap.WriteBaseMessage(ds.rw.Writer, content)
 		ds.rw.Flush()
 	}
 }
 
 func (ds *Session) handleRequest() error {
-	log.Println("Reading request...")
-	request, err := dap.ReadProtocolMessage(ds.rw.Reader)
+	content, err := dap.ReadBaseMessage(ds.rw.Reader)
 	if err != nil {
 		return err
 	}
-	log.Printf("Received request\n\t%#v\n", request)
+	ds.record(directionIn, content)
+	request, err := dap.DecodeProtocolMessage(content)
+	if err != nil {
+		ds.rejectMessage(content, err)
+		return nil
+	}
+	if disconnect, ok := request.(*dap.DisconnectRequest); ok {
+		defaultTerminateDebuggee(disconnect, content)
+	}
 	ds.sendWg.Add(1)
 	go func() {
+		defer ds.sendWg.Done()
+		defer ds.recoverRequest(request)
 		ds.dispatchRequest(request)
-		ds.sendWg.Done()
 	}()
 	return nil
 }
 
+// defaultTerminateDebuggee terminates the program on a disconnect that
+// does not say whether to, as the adapter launched it. go-dap decodes an
+// absent terminateDebuggee as false.
+func defaultTerminateDebuggee(request *dap.DisconnectRequest, content []byte) {
+	var raw struct {
+		Arguments struct {
+			TerminateDebuggee *bool `json:"terminateDebuggee"`
+		} `json:"arguments"`
+	}
+	if json.Unmarshal(content, &raw) != nil || raw.Arguments.TerminateDebuggee != nil {
+		return
+	}
+	if request.Arguments == nil {
+		request.Arguments = &dap.DisconnectArguments{}
+	}
+	request.Arguments.TerminateDebuggee = true
+}
+
+// rejectMessage answers a message that could not be decoded, e.g. a
+// request for an unknown command or with malformed arguments.
+func (ds *Session) rejectMessage(content []byte, err error) {
+	ds.log.Errorf("could not decode message: %s", err)
+
+	var header struct {
+		Seq     int    `json:"seq"`
+		Type    string `json:"type"`
+		Command string `json:"command"`
+	}
+	if json.Unmarshal(content, &header) != nil || header.Type != "request" {
+		return
+	}
+	id := errInvalidArguments
+	if fieldErr, ok := err.(*dap.DecodeProtocolMessageFieldError); ok && fieldErr.FieldName == "command" {
+		id = errUnsupported
+	}
+	ds.send(newErrorResponse(header.Seq, header.Command, id, err.Error()))
+}
+
+// recoverRequest turns a panic while handling request into an error
+// response, so that the session outlives bugs in single handlers.
+func (ds *Session) recoverRequest(request dap.Message) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	ds.log.Errorf("panic while handling %#v: %v\n%s", request, r, debug.Stack())
+	if request, ok := request.(dap.RequestMessage); ok {
+		req := request.GetRequest()
+		ds.send(newErrorResponse(req.Seq, req.Command, errInternal, fmt.Sprintf("internal error: %v", r)))
+	}
+}
+
 // dispatchRequest launches a new goroutine to process each request
 // and send back events and responses.
 
@@ -136,7 +233,6 @@ func (ds *Session) dispatchRequest(request dap.Message) {
 	case *dap.PauseRequest:
 		ds.Handler.OnPauseRequest(request)
 	case *dap.StackTraceRequest:
-		log.Printf("Trying to handle stack trace request")
 		ds.Handler.OnStackTraceRequest(request)
 	case *dap.ScopesRequest:
 		ds.Handler.OnScopesRequest(request)
@@ -177,7 +273,7 @@ func (ds *Session) dispatchRequest(request dap.Message) {
 	case *dap.BreakpointLocationsRequest:
 		ds.Handler.OnBreakpointLocationsRequest(request)
 	default:
-		log.Fatalf("Unable to process %#v", request)
+		ds.log.Errorf("Unable to process %#v", request)
 	}
 }
 
@@ -211,13 +307,47 @@ func newResponse(requestSeq int, command string) *dap.Response {
 	}
 }
 
-func newErrorResponse(requestSeq int, command string, message string) *dap.ErrorResponse {
+// Ids of the errors in error responses.
+const (
+	errUnsupported = 1000 + iota
+	errInvalidArguments
+	errLaunchFailed
+	errNotLaunched
+	errNotStopped
+	errInvalidReference
+	errEvaluationFailed
+	errCancelled
+	errInternal
+	errProgramFailed
+)
+
+// errorNames are the short forms of the errors, sent as the message of
+// error responses.
+var errorNames = map[int]string{
+	errUnsupported:      "unsupported",
+	errInvalidArguments: "invalidArguments",
+	errLaunchFailed:     "launchFailed",
+	errNotLaunched:      "notLaunched",
+	errNotStopped:       "notStopped",
+	errInvalidReference: "invalidReference",
+	errEvaluationFailed: "evaluationFailed",
+	errCancelled:        "cancelled",
+	errInternal:         "internalError",
+	errProgramFailed:    "programFailed",
+}
+
+// newErrorResponse returns a failed response to a request. message is
+// shown to the user.
+func newErrorResponse(requestSeq int, command string, id int, message string) *dap.ErrorResponse {
 	er := &dap.ErrorResponse{}
 	er.Response = *newResponse(requestSeq, command)
 	er.Success = false
-	er.Message = "unsupported"
-	er.Body.Error.Format = message
-	er.Body.Error.Id = 12345
+	er.Message = errorNames[id]
+	er.Body.Error = &dap.ErrorMessage{
+		Format:   message,
+		Id:       id,
+		ShowUser: true,
+	}
 	return er
 }
 
@@ -235,18 +365,16 @@ type Session struct {
 	sendWg    sync.WaitGroup
 
 	// stopDebug is used to notify long-running handlers to stop processing.
+	// It is closed by stop, which may be called more than once.
 	stopDebug chan struct{}
+	stopOnce  sync.Once
 
 	Handler MonkeyHandler
-	// bpSet is a counter of the remaining breakpoints that the debug
-	// session is yet to stop at before the program terminates.
-	bpSet       int
-	bpSetMux    sync.Mutex
-	breakPoints []dap.SourceBreakpoint
-	source      dap.Source
-	// rw is used to read requests and write events/responses
 
-	debuglog bool
+	// recorder records the messages of the session, if enabled.
+	recorder *recorder
+	logs     *logSink
+	log      Logger
 }
 
 type Handler interface {
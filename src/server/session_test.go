@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-dap"
+)
+
+var update = flag.Bool("update", false, "update the golden transcripts in testdata/dap")
+
+// sessionStep is a request the test client sends to the adapter. The next
+// request is sent once the response and all events in Await arrived.
+type sessionStep struct {
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Await     []string        `json:"await,omitempty"`
+}
+
+// TestSession replays the requests of each fixture in testdata/dap and
+// compares the messages exchanged with the adapter against the golden
+// transcript next to it. Run with -update to rewrite the transcripts.
+func TestSession(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/dap/*.requests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures in testdata/dap")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".requests.json")
+		t.Run(name, func(t *testing.T) {
+			content, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var steps []sessionStep
+			err = json.Unmarshal(content, &steps)
+			if err != nil {
+				t.Fatalf("could not decode fixture=%s: %s", fixture, err)
+			}
+
+			c := newReplayClient()
+			for i, step := range steps {
+				request := map[string]any{
+					"seq":     i + 1,
+					"type":    "request",
+					"command": step.Command,
+				}
+				if step.Arguments != nil {
+					request["arguments"] = step.Arguments
+				}
+				content, err := json.Marshal(request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				target := c.counts()
+				target[fmt.Sprintf("response to %d", i+1)]++
+				for _, event := range step.Await {
+					target["event "+event]++
+				}
+				err = c.send(content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = c.await(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = c.close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "dap", name+".golden.json")
+			if *update {
+				got, err := json.MarshalIndent(c.transcript, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(golden, append(got, '\n'), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			content, err = os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("could not read golden transcript, run with -update to create it: %s", err)
+			}
+			var expected []recordedMessage
+			err = json.Unmarshal(content, &expected)
+			if err != nil {
+				t.Fatalf("could not decode golden transcript=%s: %s", golden, err)
+			}
+			for i := range expected {
+				var compact bytes.Buffer
+				json.Compact(&compact, expected[i].Message)
+				expected[i].Message = compact.Bytes()
+			}
+			if diff := diffTranscripts(expected, c.transcript); len(diff) > 0 {
+				t.Errorf("transcript differs from %s:\n%s", golden, strings.Join(diff, "\n"))
+			}
+		})
+	}
+}
+
+func TestRecoverRequest(t *testing.T) {
+	ds := &Session{sendQueue: make(chan dap.Message, 1)}
+	request := &dap.VariablesRequest{}
+	request.Seq = 4
+	request.Command = "variables"
+
+	func() {
+		defer ds.recoverRequest(request)
+		panic("index out of range")
+	}()
+
+	response, ok := (<-ds.sendQueue).(*dap.ErrorResponse)
+	if !ok {
+		t.Fatalf("expected an error response")
+	}
+	if response.RequestSeq != 4 || response.Command != "variables" {
+		t.Errorf("expected a response to request 4 variables, got=%d %s", response.RequestSeq, response.Command)
+	}
+	if response.Message != "internalError" || response.Body.Error.Id != errInternal {
+		t.Errorf("expected internalError, got=%s %d", response.Message, response.Body.Error.Id)
+	}
+}
+
+func TestDefaultTerminateDebuggee(t *testing.T) {
+	tests := []struct {
+		content   string
+		terminate bool
+	}{
+		{`{"seq": 1, "type": "request", "command": "disconnect"}`, true},
+		{`{"seq": 1, "type": "request", "command": "disconnect", "arguments": {}}`, true},
+		{`{"seq": 1, "type": "request", "command": "disconnect", "arguments": {"restart": false}}`, true},
+		{`{"seq": 1, "type": "request", "command": "disconnect", "arguments": {"terminateDebuggee": true}}`, true},
+		{`{"seq": 1, "type": "request", "command": "disconnect", "arguments": {"terminateDebuggee": false}}`, false},
+	}
+	for _, tt := range tests {
+		message, err := dap.DecodeProtocolMessage([]byte(tt.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := message.(*dap.DisconnectRequest)
+		defaultTerminateDebuggee(request, []byte(tt.content))
+		if terminate := request.Arguments != nil && request.Arguments.TerminateDebuggee; terminate != tt.terminate {
+			t.Errorf("%s: expected terminateDebuggee=%t, got=%t", tt.content, tt.terminate, terminate)
+		}
+	}
+}
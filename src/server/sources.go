@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"monkeylang-debug/driver"
+
+	"github.com/google/go-dap"
+	"github.com/moritz-tiesler/monkey/object"
+)
+
+// sourceStore hands out the references of sources that do not exist on
+// disk. References are never reused.
+type sourceStore struct {
+	mu      sync.Mutex
+	sources map[int]*storedSource
+	byKey   map[string]int
+	lastRef int
+}
+
+type storedSource struct {
+	key      string
+	source   dap.Source
+	generate func() string
+	content  string
+}
+
+// builtinsKey is the key of the builtins, which do not change between
+// programs and are kept when the store is reset.
+const builtinsKey = "builtins"
+
+func newSourceStore() *sourceStore {
+	return &sourceStore{sources: make(map[int]*storedSource), byKey: make(map[string]int)}
+}
+
+// add stores the source generated by generate under key and returns the
+// source referring to it. Adding a key a second time returns the source
+// that was stored first.
+func (s *sourceStore) add(key string, name string, hint string, generate func() string) dap.Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ref, ok := s.byKey[key]; ok {
+		return s.sources[ref].source
+	}
+	s.lastRef++
+	ref := s.lastRef
+	source := dap.Source{
+		Name:             name,
+		SourceReference:  ref,
+		PresentationHint: hint,
+		Origin:           "generated by monkeylang-debug",
+	}
+	s.sources[ref] = &storedSource{key: key, source: source, generate: generate}
+	s.byKey[key] = ref
+	return source
+}
+
+// content returns the content of the source ref refers to, generating it
+// on the first request.
+func (s *sourceStore) content(ref int) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.sources[ref]
+	if !ok {
+		return "", false
+	}
+	if stored.generate != nil {
+		stored.content = stored.generate()
+		stored.generate = nil
+	}
+	return stored.content, true
+}
+
+// reset discards the sources of the program that was loaded, all but the
+// builtins.
+func (s *sourceStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ref, stored := range s.sources {
+		if stored.key != builtinsKey {
+			delete(s.sources, ref)
+			delete(s.byKey, stored.key)
+		}
+	}
+}
+
+// sourceFor returns the source of the program file at path. The file of
+// an inline program has no path and is served by reference.
+func (h *MonkeyHandler) sourceFor(d *driver.Driver, path string) dap.Source {
+	if path != "" {
+		return dap.Source{Name: filepath.Base(path), Path: path}
+	}
+	code := d.SourceCode
+	if len(d.Files) > 0 {
+		code = d.Files[0].Code
+	}
+	return h.sources.add("inline:"+code, "<inline program>", "", func() string { return code })
+}
+
+// loadedSources returns the sources of the files of the program and of
+// the builtins.
+func (h *MonkeyHandler) loadedSources(d *driver.Driver) []dap.Source {
+	sources := make([]dap.Source, 0, len(d.Files)+1)
+	for _, f := range d.Files {
+		sources = append(sources, h.sourceFor(d, f.Path))
+	}
+	return append(sources, h.builtinsSource())
+}
+
+// announceSources sends loadedSource events for the files of the program
+// that was just loaded. Files of the previous run that are no longer
+// imported are reported as removed.
+func (h *MonkeyHandler) announceSources(d *driver.Driver, previous []driver.SourceFile) {
+	known := make(map[string]bool)
+	for _, f := range previous {
+		known[f.Path] = true
+	}
+
+	current := make(map[string]bool)
+	for _, f := range d.Files {
+		current[f.Path] = true
+		reason := "new"
+		if known[f.Path] {
+			reason = "changed"
+		}
+		h.sendLoadedSource(reason, h.sourceFor(d, f.Path))
+	}
+	for _, f := range previous {
+		if !current[f.Path] {
+			h.sendLoadedSource("removed", h.sourceFor(d, f.Path))
+		}
+	}
+	if previous == nil {
+		h.sendLoadedSource("new", h.builtinsSource())
+	}
+}
+
+func (h *MonkeyHandler) sendLoadedSource(reason string, source dap.Source) {
+	e := &dap.LoadedSourceEvent{
+		Event: *newEvent("loadedSource"),
+		Body: dap.LoadedSourceEventBody{
+			Reason: reason,
+			Source: source,
+		},
+	}
+	h.session.send(e)
+}
+
+// builtinsSource returns the generated declarations of the builtins.
+func (h *MonkeyHandler) builtinsSource() dap.Source {
+	return h.sources.add(builtinsKey, "<builtins>", "deemphasize", driver.BuiltinsListing)
+}
+
+// listingSource returns the decompiled instructions of fn, keyed by its
+// index among the constants of the program.
+func (h *MonkeyHandler) listingSource(d *driver.Driver, fn *object.CompiledFunction) dap.Source {
+	name := fn.Name
+	if name == "" {
+		name = "anonymous"
+	}
+	return h.sources.add(
+		fmt.Sprintf("listing:%d:%s", d.FunctionIndex(fn), name),
+		fmt.Sprintf("<%s bytecode>", name),
+		"deemphasize",
+		func() string { return d.Listing(fn) },
+	)
+}
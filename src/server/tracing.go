@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"monkeylang-debug/driver"
+
+	"github.com/google/go-dap"
+)
+
+// configureTrace puts the driver in tracing mode if the launch
+// configuration asks for a trace. It is called on the runner.
+func (h *MonkeyHandler) configureTrace(d *driver.Driver) {
+	h.closeTrace(d)
+	h.timeline = nil
+	args := h.launchArgs
+	if args.TraceFile == "" && !args.TraceToConsole && args.Timeline == "" {
+		return
+	}
+	if args.Timeline != "" {
+		h.timeline = driver.NewTimeline()
+	}
+	timeline := h.timeline
+
+	var enc *json.Encoder
+	if args.TraceFile != "" {
+		f, err := os.OpenFile(args.TraceFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			h.log.Errorf("could not open trace file: %s", err)
+		} else {
+			h.traceFile = f
+			enc = json.NewEncoder(f)
+		}
+	}
+	d.Trace = func(entry driver.TraceEntry) {
+		if enc != nil {
+			if err := enc.Encode(entry); err != nil {
+				h.log.Errorf("could not write trace: %s", err)
+				enc = nil
+			}
+		}
+		if args.TraceToConsole {
+			h.sendTrace(d, entry)
+		}
+		if timeline != nil {
+			timeline.Add(entry)
+		}
+	}
+}
+
+// writeTimeline writes the calls of the program to the timeline file of
+// the launch configuration once the program ended or the session is over.
+// It is called on the runner.
+func (h *MonkeyHandler) writeTimeline() {
+	if h.timeline == nil {
+		return
+	}
+	timeline := h.timeline
+	h.timeline = nil
+
+	path := h.launchArgs.Timeline
+	if err := writeFile(path, timeline.Write); err != nil {
+		h.log.Errorf("could not write timeline: %s", err)
+		return
+	}
+	h.session.send(&dap.OutputEvent{
+		Event: *newEvent("output"),
+		Body: dap.OutputEventBody{
+			Category: "console",
+			Output:   fmt.Sprintf("Wrote timeline to %s, open it in Perfetto or chrome://tracing\n", path),
+		},
+	})
+}
+
+// closeTrace ends tracing and closes the trace file. It is called on the
+// runner.
+func (h *MonkeyHandler) closeTrace(d *driver.Driver) {
+	d.Trace = nil
+	if h.traceFile == nil {
+		return
+	}
+	if err := h.traceFile.Close(); err != nil {
+		h.log.Errorf("could not close trace file: %s", err)
+	}
+	h.traceFile = nil
+}
+
+// sendTrace shows entry in the debug console, indented by its depth and
+// linked to the call site. It is called on the runner.
+func (h *MonkeyHandler) sendTrace(d *driver.Driver, entry driver.TraceEntry) {
+	indent := strings.Repeat("  ", entry.Depth-1)
+	var output string
+	switch entry.Kind {
+	case "call":
+		args := make([]string, len(entry.Arguments))
+		for i, arg := range entry.Arguments {
+			args[i] = fmt.Sprintf("%s = %s", arg.Name, arg.Value)
+		}
+		output = fmt.Sprintf("%s→ %s(%s)\n", indent, entry.Function, strings.Join(args, ", "))
+	default:
+		output = fmt.Sprintf("%s← %s = %s (%d instructions)\n", indent, entry.Function, entry.Value, entry.Instructions)
+	}
+	source := h.sourceFor(d, entry.Source)
+	h.session.send(&dap.OutputEvent{
+		Event: *newEvent("output"),
+		Body: dap.OutputEventBody{
+			Category: "console",
+			Output:   output,
+			Source:   &source,
+			Line:     entry.Line,
+		},
+	})
+}